@@ -0,0 +1,398 @@
+package mixpanel
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Mixpanel accepts at most this many events in a single /track/ request
+const maxBatchSize = 50
+
+// DuplicateInsertIDPolicy decides what the batch methods do with events that share an $insert_id,
+// which Mixpanel would silently deduplicate
+type DuplicateInsertIDPolicy int
+
+const (
+	// AllowDuplicateInsertIDs sends the events as they are
+	AllowDuplicateInsertIDs DuplicateInsertIDPolicy = iota
+	// RejectDuplicateInsertIDs fails the whole batch with ErrDuplicateInsertID before anything is sent
+	RejectDuplicateInsertIDs
+	// DropDuplicateInsertIDs only sends the first event with each $insert_id
+	DropDuplicateInsertIDs
+)
+
+// Priority decides which events a Collector keeps under backpressure
+type Priority int
+
+const (
+	// PriorityNormal events are sampled once a Collector's queue fills up past SampleAbove
+	PriorityNormal Priority = iota
+	// PriorityHigh events are never sampled
+	PriorityHigh
+)
+
+// Event is a single Mixpanel event as sent by the batch methods
+type Event struct {
+	Name       string
+	Properties map[string]interface{}
+	// Priority is only used by Collectors (defaults to PriorityNormal)
+	Priority Priority
+}
+
+// AliasPair maps a distinct ID that is already in use to the new ID it should also be known by
+type AliasPair struct {
+	OldID string
+	NewID string
+}
+
+// AliasBatch alias'es every OldID to its NewID, sending the "$create_alias" events
+// 50 per request instead of one request per pair.
+// Mixpanel only honors the first alias created for a given new ID, so a NewID that appears
+// more than once is rejected with ErrDuplicateAlias before anything is sent. The pairs are
+// sent in the order given, and events for a NewID should only be tracked once AliasBatch
+// has returned, otherwise they may be attributed to a profile of their own.
+// A failed batch does not stop the remaining ones from being sent; the returned *BatchError
+// lists every batch that failed.
+// e.g. `err := m.AliasBatch([]mixpanel.AliasPair{{OldID: "deadbeef", NewID: "1"}})`
+func (m *Mixpanel) AliasBatch(pairs []AliasPair) error {
+	seen := make(map[string]bool, len(pairs))
+	events := make([]Event, len(pairs))
+
+	for i, pair := range pairs {
+		if seen[pair.NewID] {
+			return ErrDuplicateAlias
+		}
+		seen[pair.NewID] = true
+
+		events[i] = Event{
+			Name:       "$create_alias",
+			Properties: map[string]interface{}{"distinct_id": pair.OldID, "alias": pair.NewID},
+		}
+	}
+
+	return m.trackBatch(context.Background(), events, nil)
+}
+
+// TrackBatch tracks the events, prepared the way Track prepares them, sending them 50 per request
+// instead of one request per event. An event rejected by its schema fails the whole batch before
+// anything is sent. A failed request does not stop the remaining ones from being sent; the
+// returned *BatchError lists every request that failed, with its index and events
+// e.g. `err := m.TrackBatch([]mixpanel.Event{{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "1"}}})`
+func (m *Mixpanel) TrackBatch(events []Event) error {
+	return m.TrackBatchContext(context.Background(), events)
+}
+
+// TrackBatchContext is like TrackBatch, but abandons the requests when ctx is done, and completes
+// the events from ctx the way TrackContext does
+func (m *Mixpanel) TrackBatchContext(ctx context.Context, events []Event) error {
+	b := m.NewBatch()
+	for _, event := range events {
+		if err := b.Track(event.Name, m.contextProperties(ctx, event.Properties)); err != nil {
+			return err
+		}
+	}
+
+	return b.Flush(ctx)
+}
+
+// withEventNameAliases returns the event followed by a copy of it under each alias name. The
+// copies of an event with an $insert_id get one derived from it, so that they are deduplicated
+// whenever the event is
+func withEventNameAliases(event Event, aliases []string) []Event {
+	events := []Event{event}
+	insertID, _ := event.Properties["$insert_id"].(string)
+
+	for _, alias := range aliases {
+		properties := make(map[string]interface{}, len(event.Properties)+1)
+		for key, value := range event.Properties {
+			properties[key] = value
+		}
+		if len(insertID) > 0 {
+			sum := sha256.Sum256([]byte(insertID + "\x00" + alias))
+			// Mixpanel caps insert IDs at 36 characters
+			properties["$insert_id"] = hex.EncodeToString(sum[:16])
+		} else {
+			properties["$insert_id"] = randomID()
+		}
+
+		events = append(events, Event{Name: alias, Properties: properties})
+	}
+
+	return events
+}
+
+// ChunkError is the failure of a single request sent by a batch method
+type ChunkError struct {
+	// Index is the position of the failed request among those the batch was split into
+	Index int
+	// Events are the events the failed request carried, e.g. to be sent again
+	Events []Event
+	Err    error
+}
+
+// BatchError is returned by the batch methods when some of their requests failed, or some of the
+// profile updates of the events that were delivered.
+// The requests that aren't listed were sent successfully
+type BatchError struct {
+	chunks        int
+	errors        []ChunkError
+	profileErrors []error
+}
+
+// Errors lists the requests that failed, in the order they were sent
+// e.g. `for _, failed := range err.(*mixpanel.BatchError).Errors() { retry(failed.Events) }`
+func (e *BatchError) Errors() []ChunkError {
+	return e.errors
+}
+
+// ProfileErrors lists the EventTags and FirstTouchProperties profile updates that failed for the
+// events that were delivered
+// e.g. `for _, err := range err.(*mixpanel.BatchError).ProfileErrors() { log.Print(err) }`
+func (e *BatchError) ProfileErrors() []error {
+	return e.profileErrors
+}
+
+// Unwrap returns the errors of the failed requests and profile updates, so that errors.Is and
+// errors.As see them
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.errors)+len(e.profileErrors))
+	for _, failed := range e.errors {
+		errs = append(errs, failed.Err)
+	}
+
+	return append(errs, e.profileErrors...)
+}
+
+func (e *BatchError) Error() string {
+	var failures []string
+	for _, failed := range e.errors {
+		failures = append(failures, fmt.Sprintf("batch %d: %v", failed.Index, failed.Err))
+	}
+	for _, err := range e.profileErrors {
+		failures = append(failures, err.Error())
+	}
+
+	if len(e.errors) == 0 {
+		return fmt.Sprintf("%d Mixpanel profile updates failed (%s)", len(e.profileErrors), strings.Join(failures, "; "))
+	}
+
+	return fmt.Sprintf("%d of %d Mixpanel batches failed (%s)", len(e.errors), e.chunks, strings.Join(failures, "; "))
+}
+
+// randomID returns a random hex ID, e.g. for Mixpanel to deduplicate an event by
+func randomID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func (m *Mixpanel) trackBatch(ctx context.Context, events []Event, params url.Values) error {
+	events, err := m.checkInsertIDs(events)
+	if err != nil {
+		return err
+	}
+	if events, err = m.unsentEvents(ctx, events); err != nil {
+		return err
+	}
+
+	chunks := m.chunkEvents(events)
+	batchErr := &BatchError{chunks: len(chunks)}
+
+	for i, chunk := range chunks {
+		if err := m.sendBatch(ctx, trackPath, chunk, params); err != nil {
+			m.deadLetter(chunk, err)
+			batchErr.errors = append(batchErr.errors, ChunkError{Index: i, Events: chunk, Err: err})
+		} else {
+			m.markSent(ctx, chunk)
+		}
+	}
+
+	if len(batchErr.errors) > 0 {
+		return batchErr
+	}
+
+	return nil
+}
+
+// checkInsertIDs applies the DuplicateInsertIDs policy to events
+func (m *Mixpanel) checkInsertIDs(events []Event) ([]Event, error) {
+	if m.DuplicateInsertIDs == AllowDuplicateInsertIDs {
+		return events, nil
+	}
+
+	seen := make(map[string]bool, len(events))
+	unique := make([]Event, 0, len(events))
+
+	for _, event := range events {
+		// Mixpanel only deduplicates by string insert IDs, so any other value counts as none
+		insertID, ok := event.Properties["$insert_id"].(string)
+		if ok && seen[insertID] {
+			if m.DuplicateInsertIDs == RejectDuplicateInsertIDs {
+				return nil, ErrDuplicateInsertID
+			}
+			continue
+		}
+		if ok {
+			seen[insertID] = true
+		}
+
+		unique = append(unique, event)
+	}
+
+	return unique, nil
+}
+
+// chunkEvents splits events into batches of at most 50 events whose encoded size stays within
+// MaxPayloadBytes. An event that is too large on its own is sent in a batch of its own
+func (m *Mixpanel) chunkEvents(events []Event) [][]Event {
+	maxBytes := m.maxPayloadBytes()
+	var chunks [][]Event
+	var chunk []Event
+	// the brackets around the JSON array
+	chunkBytes := 2
+
+	for _, event := range events {
+		event.Properties["token"] = m.Token
+		// the properties are re-encoded for sending; an event that fails to encode is sized as
+		// empty here and reported when its batch is sent
+		encoded, _ := json.Marshal(map[string]interface{}{"event": event.Name, "properties": event.Properties})
+		// base64 encoding grows the payload by a third
+		eventBytes := base64.StdEncoding.EncodedLen(len(encoded) + 1)
+
+		if len(chunk) > 0 && (len(chunk) == maxBatchSize || chunkBytes+eventBytes > maxBytes) {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			chunkBytes = 2
+		}
+
+		chunk = append(chunk, event)
+		chunkBytes += eventBytes
+	}
+
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+func (m *Mixpanel) sendBatch(ctx context.Context, path string, events []Event, params url.Values) error {
+	data := make([]map[string]interface{}, len(events))
+
+	for i, event := range events {
+		data[i] = map[string]interface{}{"event": event.Name, "properties": event.Properties}
+	}
+
+	response, err := m.send(ctx, path, params, data)
+	if err != nil {
+		return err
+	}
+
+	return m.checkResponse(response, ErrUnexpectedTrackResponse)
+}
+
+// Batch collects the events tracked while handling a single request, or any other unit of work,
+// and sends them together when it is flushed. Nothing is sent until Flush is called.
+// A Batch is safe for concurrent use
+type Batch struct {
+	m      *Mixpanel
+	mu     sync.Mutex
+	events []Event
+	// tracked keeps the events as tracked, before EventNameAliases copies, for their profile updates
+	tracked []Event
+}
+
+// NewBatch returns an empty Batch sending through m
+// e.g. `b := m.NewBatch(); defer b.Flush(r.Context())`
+func (m *Mixpanel) NewBatch() *Batch {
+	return &Batch{m: m}
+}
+
+// Track adds the event to the batch, preparing its properties the way Track does, e.g. stamping
+// its time. It only returns an error when the event is rejected, e.g. by its schema
+// e.g. `err := b.Track("Search", map[string]interface{}{"distinct_id": "1"})`
+func (b *Batch) Track(event string, properties map[string]interface{}) error {
+	properties = copyProperties(properties)
+
+	if err := b.m.prepareEvent(event, properties); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tracked = append(b.tracked, Event{Name: event, Properties: properties})
+	b.events = append(b.events, withEventNameAliases(Event{Name: event, Properties: properties}, b.m.EventNameAliases[event])...)
+
+	return nil
+}
+
+// Flush sends the events tracked since the last Flush in as few requests as possible, and leaves
+// the batch empty. A failed request does not stop the remaining ones from being sent; the
+// returned *BatchError lists every request that failed. The profile updates of the events that
+// were delivered are made even when other requests failed, and the *BatchError lists those that
+// failed as well
+func (b *Batch) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	events, tracked := b.events, b.tracked
+	b.events, b.tracked = nil, nil
+	b.mu.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	return b.m.updateTrackedProfiles(ctx, tracked, b.m.trackBatch(ctx, events, nil))
+}
+
+// updateTrackedProfiles makes the profile updates of the tracked events that were delivered, given
+// the error trackBatch returned for them, and returns that error with the failed updates added to it.
+// An error other than a *BatchError means that nothing was sent
+func (m *Mixpanel) updateTrackedProfiles(ctx context.Context, tracked []Event, err error) error {
+	batchErr, ok := err.(*BatchError)
+	if err != nil && !ok {
+		return err
+	}
+
+	// the tracked events share their properties with the events that were sent
+	failed := make(map[uintptr]bool)
+	if batchErr != nil {
+		for _, chunk := range batchErr.errors {
+			for _, event := range chunk.Events {
+				failed[reflect.ValueOf(event.Properties).Pointer()] = true
+			}
+		}
+	}
+
+	var profileErrors []error
+	for _, event := range tracked {
+		if failed[reflect.ValueOf(event.Properties).Pointer()] {
+			continue
+		}
+		if err := m.updateTrackedProfile(ctx, event.Name, event.Properties); err != nil {
+			profileErrors = append(profileErrors, fmt.Errorf("could not update the profile tracked by the %q event: %w", event.Name, err))
+		}
+	}
+
+	if len(profileErrors) == 0 {
+		return err
+	}
+	if batchErr == nil {
+		batchErr = &BatchError{}
+	}
+	batchErr.profileErrors = profileErrors
+
+	return batchErr
+}
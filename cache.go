@@ -0,0 +1,129 @@
+package mixpanel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// lruCache is a goroutine-safe cache keyed by string. Once it holds size entries
+// the least recently used one is evicted (size <= 0 means unbounded), and entries
+// older than ttl are treated as missing and swept periodically (ttl <= 0 means
+// entries never expire).
+type lruCache struct {
+	mu        sync.Mutex
+	size      int
+	ttl       time.Duration
+	ll        *list.List
+	entries   map[string]*list.Element
+	lastSweep time.Time
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	created time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:      size,
+		ttl:       ttl,
+		ll:        list.New(),
+		entries:   make(map[string]*list.Element),
+		lastSweep: time.Now(),
+	}
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if c.expired(entry, time.Now()) {
+		c.remove(element)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.sweep(now)
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.created = now
+		c.ll.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&lruEntry{key: key, value: value, created: now})
+
+	if c.size > 0 && c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Remove deletes the entry for key, returning its value if it was present and not expired
+func (c *lruCache) Remove(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.remove(element)
+
+	entry := element.Value.(*lruEntry)
+	if c.expired(entry, time.Now()) {
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
+
+func (c *lruCache) expired(entry *lruEntry, now time.Time) bool {
+	return c.ttl > 0 && now.Sub(entry.created) > c.ttl
+}
+
+// sweep drops every expired entry, at most once per ttl so that Set stays cheap
+func (c *lruCache) sweep(now time.Time) {
+	if c.ttl <= 0 || now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	c.lastSweep = now
+
+	for element := c.ll.Front(); element != nil; {
+		next := element.Next()
+		if c.expired(element.Value.(*lruEntry), now) {
+			c.remove(element)
+		}
+		element = next
+	}
+}
+
+func (c *lruCache) remove(element *list.Element) {
+	c.ll.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry).key)
+}
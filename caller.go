@@ -0,0 +1,40 @@
+package mixpanel
+
+import (
+	"runtime"
+	"strings"
+)
+
+const sourceFunctionProperty = "$source_function"
+
+// packagePrefix prefixes the names of this package's functions, e.g. "github.com/nitrous-io/go-mixpanel."
+var packagePrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+strings.Index(name[slash:], ".")+1]
+}()
+
+// captureCaller sets "$source_function" to the function outside this package that tracked the event
+func (m *Mixpanel) captureCaller(properties map[string]interface{}) {
+	if !m.CaptureCaller || properties == nil {
+		return
+	}
+	if _, ok := properties[sourceFunctionProperty]; ok {
+		return
+	}
+
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, packagePrefix) {
+			properties[sourceFunctionProperty] = frame.Function
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package mixpanel
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// This error is returned by Submit when a normal priority event is sampled out under backpressure
+	ErrEventSampledOut = fmt.Errorf("Mixpanel Event Sampled Out Under Backpressure")
+	// This error is returned by Submit once the Collector is closed
+	ErrCollectorClosed = fmt.Errorf("Mixpanel Collector Closed")
+)
+
+const (
+	defaultCollectorQueueSize     = 1000
+	defaultCollectorFlushInterval = time.Second
+)
+
+// CollectorConfig configures a Collector
+type CollectorConfig struct {
+	// Shards is the number of independent batching pipelines that submitted events are spread
+	// across, so that many producers don't contend on a single channel (defaults to GOMAXPROCS)
+	Shards int
+	// QueueSize is the number of events each shard holds before Submit blocks (defaults to 1000)
+	QueueSize int
+	// FlushInterval is the longest an event waits for its batch to fill up (defaults to 1 second)
+	FlushInterval time.Duration
+	// SampleAbove is the fraction of a shard's queue that can fill up before normal priority events
+	// are sampled: above it an increasing share of them is dropped, up to all of them when the queue
+	// is full, while high priority events still wait for room. Zero never samples
+	// e.g. `mixpanel.CollectorConfig{SampleAbove: 0.5}`
+	SampleAbove float64
+	// Compact, if set, is given the events of each batch before it is sent and returns the events
+	// to send instead, e.g. merging repeated events into one with CompactByCount. Compacted events
+	// lose what told the originals apart, like their times, so it only suits events whose
+	// aggregate is enough. It only sees the events that reached one shard in one flush, including
+	// their EventNameAliases copies, and the EventTags and FirstTouchProperties profile updates are
+	// still made for every submitted event
+	Compact func(events []Event) []Event
+}
+
+// Collector coalesces events submitted by many goroutines into shared batches of up to 50 events,
+// sent in the background. Events that can't be delivered are passed to the client's OnDeadLetter
+type Collector struct {
+	m      *Mixpanel
+	config CollectorConfig
+	// each submitted event is queued along with its EventNameAliases copies
+	shards []chan []Event
+	next   uint64
+	wg     sync.WaitGroup
+
+	// closedMu keeps Close from closing a shard that Submit is sending to
+	closedMu sync.RWMutex
+	closed   bool
+}
+
+// NewCollector starts a Collector sending its batches through m
+// e.g. `c := m.NewCollector(mixpanel.CollectorConfig{FlushInterval: 5 * time.Second})`
+func (m *Mixpanel) NewCollector(config CollectorConfig) *Collector {
+	if config.Shards <= 0 {
+		config.Shards = runtime.GOMAXPROCS(0)
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultCollectorQueueSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultCollectorFlushInterval
+	}
+
+	c := &Collector{m: m, config: config, shards: make([]chan []Event, config.Shards)}
+	for i := range c.shards {
+		c.shards[i] = make(chan []Event, config.QueueSize)
+		c.wg.Add(1)
+		go c.run(c.shards[i])
+	}
+
+	return c
+}
+
+// Submit queues the event for the next batch, preparing its properties the way Track does.
+// It only returns an error when the event is rejected up front, e.g. by its schema, or when it is
+// sampled out under backpressure with ErrEventSampledOut, or once the Collector is closed with
+// ErrCollectorClosed. Submit is safe to call from many goroutines
+// e.g. `err := c.Submit(mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"$distinct_id": "1"}})`
+func (c *Collector) Submit(event Event) error {
+	c.closedMu.RLock()
+	defer c.closedMu.RUnlock()
+
+	if c.closed {
+		return ErrCollectorClosed
+	}
+
+	shard := c.shards[atomic.AddUint64(&c.next, 1)%uint64(len(c.shards))]
+	if event.Priority == PriorityNormal && c.sampledOut(shard) {
+		return ErrEventSampledOut
+	}
+
+	event.Properties = copyProperties(event.Properties)
+
+	if err := c.m.prepareEvent(event.Name, event.Properties); err != nil {
+		return err
+	}
+
+	shard <- withEventNameAliases(event, c.m.EventNameAliases[event.Name])
+
+	return nil
+}
+
+// sampledOut decides whether to drop a normal priority event given how full shard's queue is
+func (c *Collector) sampledOut(shard chan []Event) bool {
+	if c.config.SampleAbove <= 0 {
+		return false
+	}
+
+	depth := float64(len(shard)) / float64(cap(shard))
+	if depth <= c.config.SampleAbove {
+		return false
+	}
+
+	return rand.Float64() < (depth-c.config.SampleAbove)/(1-c.config.SampleAbove)
+}
+
+// Close sends the events still queued and waits for every batch to be sent
+func (c *Collector) Close() {
+	c.closedMu.Lock()
+	if !c.closed {
+		c.closed = true
+		for _, shard := range c.shards {
+			close(shard)
+		}
+	}
+	c.closedMu.Unlock()
+
+	c.wg.Wait()
+}
+
+func (c *Collector) run(shard chan []Event) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.config.FlushInterval)
+	defer ticker.Stop()
+
+	var batch, tracked []Event
+	flush := func() {
+		if len(batch) > 0 && c.config.Compact != nil {
+			batch = c.config.Compact(batch)
+		}
+		var err error
+		if len(batch) > 0 {
+			err = c.m.trackBatch(context.Background(), batch, nil)
+		}
+		// failed requests are reported per event through OnDeadLetter, and like Batch.Flush the events
+		// that were delivered still get their profile updates
+		if batchErr, ok := c.m.updateTrackedProfiles(context.Background(), tracked, err).(*BatchError); ok {
+			for _, err := range batchErr.ProfileErrors() {
+				c.m.warn(err.Error())
+			}
+		}
+		batch, tracked = nil, nil
+	}
+
+	for {
+		select {
+		case events, ok := <-shard:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, events...)
+			tracked = append(tracked, events[0])
+			if len(batch) >= maxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// CompactByCount returns a Collector Compact strategy merging the events of a batch that share an
+// event name and distinct ID into the first of them, which carries the number of events it
+// stands for in the property. Events without a distinct ID are left as they are
+// e.g. `mixpanel.CollectorConfig{Compact: mixpanel.CompactByCount("count")}`
+func CompactByCount(property string) func(events []Event) []Event {
+	return func(events []Event) []Event {
+		type compactionKey struct{ name, distinctID string }
+		merged := make(map[compactionKey]Event)
+		compacted := make([]Event, 0, len(events))
+
+		for _, event := range events {
+			distinctID := distinctIDOf(event.Properties)
+			if len(distinctID) == 0 {
+				compacted = append(compacted, event)
+				continue
+			}
+
+			key := compactionKey{event.Name, distinctID}
+			if first, ok := merged[key]; ok {
+				first.Properties[property] = first.Properties[property].(int) + 1
+				continue
+			}
+
+			event.Properties[property] = 1
+			merged[key] = event
+			compacted = append(compacted, event)
+		}
+
+		return compacted
+	}
+}
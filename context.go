@@ -0,0 +1,62 @@
+package mixpanel
+
+import "context"
+
+type distinctIDKey struct{}
+
+// ContextWithDistinctID returns a copy of ctx carrying the distinct ID, e.g. from a middleware that
+// knows the user, so that TrackContext calls further down can leave it out of their properties
+// e.g. `ctx = mixpanel.ContextWithDistinctID(r.Context(), user.ID)`
+func ContextWithDistinctID(ctx context.Context, distinctID string) context.Context {
+	return context.WithValue(ctx, distinctIDKey{}, distinctID)
+}
+
+// DistinctIDFromContext returns the distinct ID stored in ctx by ContextWithDistinctID
+func DistinctIDFromContext(ctx context.Context) (string, bool) {
+	distinctID, ok := ctx.Value(distinctIDKey{}).(string)
+	return distinctID, ok && len(distinctID) > 0
+}
+
+// contextProperties returns a copy of properties completed from ctx: with the properties of the
+// ContextExtractors, and with the distinct ID stored by ContextWithDistinctID when they carry none
+func (m *Mixpanel) contextProperties(ctx context.Context, properties map[string]interface{}) map[string]interface{} {
+	properties = m.withContextProperties(ctx, copyProperties(properties))
+	m.normalizeDistinctID(properties)
+	if distinctID, ok := DistinctIDFromContext(ctx); ok && len(distinctIDOf(properties)) == 0 {
+		properties["distinct_id"] = distinctID
+	}
+
+	return properties
+}
+
+// withContextProperties merges the properties that ContextExtractors find in ctx into properties,
+// allocating them if needed. Explicit properties take precedence, and nil values are left out, so
+// that an extractor can return a ctx.Value that isn't set
+func (m *Mixpanel) withContextProperties(ctx context.Context, properties map[string]interface{}) map[string]interface{} {
+	if len(m.ContextExtractors) == 0 {
+		return properties
+	}
+
+	extracted := make(map[string]interface{})
+	for _, extract := range m.ContextExtractors {
+		for key, value := range extract(ctx) {
+			if value != nil {
+				extracted[key] = value
+			}
+		}
+	}
+	if len(extracted) == 0 {
+		return properties
+	}
+
+	if properties == nil {
+		properties = make(map[string]interface{}, len(extracted))
+	}
+	for key, value := range extracted {
+		if _, ok := properties[key]; !ok {
+			properties[key] = value
+		}
+	}
+
+	return properties
+}
@@ -0,0 +1,47 @@
+package mixpanel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// cookieName returns the name of the cookie the Mixpanel JavaScript library keeps its state in
+func (m *Mixpanel) cookieName() string {
+	return "mp_" + m.Token + "_mixpanel"
+}
+
+// DistinctIDFromRequest returns the distinct ID the Mixpanel JavaScript library stored in the
+// request's "mp_<token>_mixpanel" cookie, so that server side events are attributed to the same
+// (possibly anonymous) user as the events tracked in their browser
+// e.g. `if distinctID, ok := m.DistinctIDFromRequest(r); ok { ctx = mixpanel.ContextWithDistinctID(ctx, distinctID) }`
+func (m *Mixpanel) DistinctIDFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(m.cookieName())
+	if err != nil {
+		return "", false
+	}
+
+	// the library URL encodes the JSON it stores
+	value, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return "", false
+	}
+
+	var state struct {
+		DistinctID interface{} `json:"distinct_id"`
+	}
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return "", false
+	}
+
+	// older versions of the library store numeric IDs as JSON numbers
+	switch distinctID := state.DistinctID.(type) {
+	case string:
+		return distinctID, len(distinctID) > 0
+	case float64:
+		encoded, _ := json.Marshal(distinctID)
+		return string(encoded), true
+	}
+
+	return "", false
+}
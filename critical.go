@@ -0,0 +1,38 @@
+package mixpanel
+
+import "context"
+
+// criticalAttempts is the fewest times TrackCritical sends a batch before giving up
+const criticalAttempts = 3
+
+// TrackCritical tracks an event that must not be lost, e.g. "Payment Completed", bypassing any
+// Collector and OrderedDelivery: it is sent right away, and retried as Retry configures but with
+// at least 3 attempts before the error is returned. The event gets an $insert_id if it has none,
+// so that Mixpanel discards the duplicates left by a retried request that had actually succeeded
+// e.g. `err := m.TrackCritical(ctx, "Payment Completed", map[string]interface{}{"distinct_id": "1"})`
+func (m *Mixpanel) TrackCritical(ctx context.Context, event string, properties map[string]interface{}) error {
+	properties = m.contextProperties(ctx, properties)
+
+	// before prepareEvent, so that MaxProperties counts it
+	if _, ok := properties["$insert_id"]; !ok {
+		properties["$insert_id"] = randomID()
+	}
+	if err := m.prepareEvent(event, properties); err != nil {
+		return err
+	}
+
+	events, err := m.unsentEvents(ctx, withEventNameAliases(Event{Name: event, Properties: properties}, m.EventNameAliases[event]))
+	if err != nil {
+		return err
+	}
+
+	for _, chunk := range m.chunkEvents(events) {
+		if err := m.sendBatch(withMinAttempts(ctx, criticalAttempts), trackPath, chunk, nil); err != nil {
+			m.deadLetter(chunk, err)
+			return err
+		}
+		m.markSent(ctx, chunk)
+	}
+
+	return m.updateTrackedProfile(ctx, event, properties)
+}
@@ -0,0 +1,105 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	deliveryPollBackoff    = time.Second
+	deliveryPollMaxBackoff = 30 * time.Second
+)
+
+// Mixpanel's encoding for the hourly buckets of segmentation results
+const segmentationHourFormat = "2006-01-02 15:04:05"
+
+type segmentationResponse struct {
+	Data struct {
+		Values map[string]map[string]int `json:"values"`
+	} `json:"data"`
+}
+
+// VerifyEventDelivered polls the segmentation API, with an increasing delay, until it counts at
+// least one event named event since the given time, and reports whether it did before timeout ran
+// out. Segmentation counts by the hour, so events sent earlier in since's hour count as well: give
+// the event a name of its own, e.g. with a run ID, for an exact answer.
+// Hours are those of the project's timezone when ProjectID is set, and UTC otherwise.
+// Meant for end-to-end tests against a test project; requires APISecret to be set
+// e.g. `ok, err := m.VerifyEventDelivered(ctx, "Payment Completed", start, time.Minute)`
+func (m *Mixpanel) VerifyEventDelivered(ctx context.Context, event string, since time.Time, timeout time.Duration) (bool, error) {
+	location := time.UTC
+	if m.ProjectID != 0 {
+		var err error
+		if location, err = m.ProjectTimezone(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	backoff := deliveryPollBackoff
+
+	for {
+		count, err := m.segmentationCount(ctx, event, since.In(location))
+		if err != nil || count > 0 {
+			return count > 0, err
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return false, nil
+		}
+		if wait > backoff {
+			wait = backoff
+		}
+
+		select {
+		case <-time.After(wait):
+			if backoff *= 2; backoff > deliveryPollMaxBackoff {
+				backoff = deliveryPollMaxBackoff
+			}
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// segmentationCount returns the number of events named event in the hourly buckets from since's on
+func (m *Mixpanel) segmentationCount(ctx context.Context, event string, since time.Time) (int, error) {
+	params := url.Values{}
+	params.Set("event", event)
+	params.Set("unit", "hour")
+	params.Set("from_date", since.Format("2006-01-02"))
+	params.Set("to_date", time.Now().In(since.Location()).Format("2006-01-02"))
+	if m.ProjectID != 0 {
+		params.Set("project_id", strconv.Itoa(m.ProjectID))
+	}
+
+	// polling needs fresh counts, whatever QueryCacheTTL says
+	body, err := m.fetchQuery(ctx, "/2.0/segmentation", params)
+	if err != nil {
+		return 0, err
+	}
+
+	var response segmentationResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return 0, err
+	}
+
+	// not Truncate, which would be off in timezones with a half-hour offset
+	from := time.Date(since.Year(), since.Month(), since.Day(), since.Hour(), 0, 0, 0, since.Location())
+	count := 0
+	for bucket, value := range response.Data.Values[event] {
+		hour, err := time.ParseInLocation(segmentationHourFormat, bucket, since.Location())
+		if err != nil {
+			return 0, ErrUnexpectedQueryResponse
+		}
+		if !hour.Before(from) {
+			count += value
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,26 @@
+package mixpanel
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// deprecationHeaders are the response headers Mixpanel may announce the retirement of an endpoint in
+var deprecationHeaders = []string{"Warning", "Deprecation", "Sunset"}
+
+// observeDeprecation passes the deprecation notices of a response for path to OnWarning,
+// once per distinct notice so that a busy client doesn't repeat them on every request
+func (m *Mixpanel) observeDeprecation(path string, header http.Header) {
+	if m.OnWarning == nil {
+		return
+	}
+
+	for _, name := range deprecationHeaders {
+		for _, value := range header.Values(name) {
+			notice := fmt.Sprintf("Mixpanel %s header for %s: %s", name, path, value)
+			if _, seen := m.deprecations.LoadOrStore(notice, true); !seen {
+				m.warn(notice)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mixpanel
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+// Geo is a location resolved by the caller rather than by Mixpanel's IP geolocation
+type Geo struct {
+	City   string
+	Region string
+	// CountryCode is an ISO 3166-1 alpha-2 code, e.g. "GB"
+	CountryCode string
+}
+
+// TrackWithGeo tracks the event for distinctID with the "$city", "$region" and "$country_code"
+// properties taken from geo, and tells Mixpanel not to geolocate the request's IP address so that
+// they aren't overridden. Empty Geo fields are left out
+// e.g. `err := m.TrackWithGeo("1", "Check In", mixpanel.Geo{City: "London", CountryCode: "GB"}, nil)`
+func (m *Mixpanel) TrackWithGeo(distinctID, event string, geo Geo, properties map[string]interface{}) error {
+	countryCode := strings.ToUpper(geo.CountryCode)
+	if len(countryCode) > 0 && !isoCountryCodes[countryCode] {
+		return ErrInvalidCountryCode
+	}
+
+	properties = copyProperties(properties)
+	properties["distinct_id"] = distinctID
+	if len(geo.City) > 0 {
+		properties["$city"] = geo.City
+	}
+	if len(geo.Region) > 0 {
+		properties["$region"] = geo.Region
+	}
+	if len(countryCode) > 0 {
+		properties["$country_code"] = countryCode
+	}
+
+	return m.trackEvent(context.Background(), event, properties, url.Values{"ip": {"0"}})
+}
+
+// isoCountryCodes holds the officially assigned ISO 3166-1 alpha-2 codes
+var isoCountryCodes = make(map[string]bool)
+
+func init() {
+	for _, code := range strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+		BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+		CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+		DE DJ DK DM DO DZ
+		EC EE EG EH ER ES ET
+		FI FJ FK FM FO FR
+		GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+		HK HM HN HR HT HU
+		ID IE IL IM IN IO IQ IR IS IT
+		JE JM JO JP
+		KE KG KH KI KM KN KP KR KW KY KZ
+		LA LB LC LI LK LR LS LT LU LV LY
+		MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+		NA NC NE NF NG NI NL NO NP NR NU NZ
+		OM
+		PA PE PF PG PH PK PL PM PN PR PS PT PW PY
+		QA
+		RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+		TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ
+		UA UG UM US UY UZ
+		VA VC VE VG VI VN VU
+		WF WS
+		YE YT
+		ZA ZM ZW`) {
+		isoCountryCodes[code] = true
+	}
+}
@@ -0,0 +1,75 @@
+package mixpanel
+
+import "context"
+
+// GroupSet sets properties on the group profile referenced by the groupKey (the group's
+// property, e.g. "company_id") and the groupID (its value, e.g. "acme")
+// e.g. `err := m.GroupSet("company_id", "acme", map[string]interface{}{"plan": "enterprise"})`
+func (m *Mixpanel) GroupSet(groupKey, groupID string, properties map[string]interface{}) error {
+	return m.GroupSetContext(context.Background(), groupKey, groupID, properties)
+}
+
+// GroupSetContext is like GroupSet, but abandons the request when ctx is done
+func (m *Mixpanel) GroupSetContext(ctx context.Context, groupKey, groupID string, properties map[string]interface{}) error {
+	return m.group(ctx, groupKey, groupID, "$set", properties)
+}
+
+// GroupSetOnce sets properties that are not already set on the group profile
+// e.g. `err := m.GroupSetOnce("company_id", "acme", map[string]interface{}{"signed_up": "2021-03-04"})`
+func (m *Mixpanel) GroupSetOnce(groupKey, groupID string, properties map[string]interface{}) error {
+	return m.GroupSetOnceContext(context.Background(), groupKey, groupID, properties)
+}
+
+// GroupSetOnceContext is like GroupSetOnce, but abandons the request when ctx is done
+func (m *Mixpanel) GroupSetOnceContext(ctx context.Context, groupKey, groupID string, properties map[string]interface{}) error {
+	return m.group(ctx, groupKey, groupID, "$set_once", properties)
+}
+
+// GroupUnion unions values to the given list properties of the group profile
+// e.g. `err := m.GroupUnion("company_id", "acme", map[string]interface{}{"products": []string{"analytics"}})`
+func (m *Mixpanel) GroupUnion(groupKey, groupID string, properties map[string]interface{}) error {
+	return m.GroupUnionContext(context.Background(), groupKey, groupID, properties)
+}
+
+// GroupUnionContext is like GroupUnion, but abandons the request when ctx is done
+func (m *Mixpanel) GroupUnionContext(ctx context.Context, groupKey, groupID string, properties map[string]interface{}) error {
+	return m.group(ctx, groupKey, groupID, "$union", properties)
+}
+
+// GroupUnset removes the given properties from the group profile
+// e.g. `err := m.GroupUnset("company_id", "acme", []string{"trial_ends"})`
+func (m *Mixpanel) GroupUnset(groupKey, groupID string, properties []string) error {
+	return m.GroupUnsetContext(context.Background(), groupKey, groupID, properties)
+}
+
+// GroupUnsetContext is like GroupUnset, but abandons the request when ctx is done
+func (m *Mixpanel) GroupUnsetContext(ctx context.Context, groupKey, groupID string, properties []string) error {
+	return m.group(ctx, groupKey, groupID, "$unset", properties)
+}
+
+// GroupDelete deletes the group profile
+// e.g. `err := m.GroupDelete("company_id", "acme")`
+func (m *Mixpanel) GroupDelete(groupKey, groupID string) error {
+	return m.GroupDeleteContext(context.Background(), groupKey, groupID)
+}
+
+// GroupDeleteContext is like GroupDelete, but abandons the request when ctx is done
+func (m *Mixpanel) GroupDeleteContext(ctx context.Context, groupKey, groupID string) error {
+	return m.group(ctx, groupKey, groupID, "$delete", "")
+}
+
+func (m *Mixpanel) group(ctx context.Context, groupKey, groupID string, op string, properties interface{}) error {
+	var data map[string]interface{} = make(map[string]interface{})
+
+	data["$token"] = m.Token
+	data["$group_key"] = groupKey
+	data["$group_id"] = groupID
+	data[op] = properties
+
+	response, err := m.send(ctx, groupsPath, nil, data)
+	if err != nil {
+		return err
+	}
+
+	return m.checkResponse(response, ErrUnexpectedGroupResponse)
+}
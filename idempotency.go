@@ -0,0 +1,80 @@
+package mixpanel
+
+import (
+	"context"
+	"fmt"
+)
+
+// IdempotencyStore remembers the $insert_id of the events that were sent, so that a client
+// configured with it skips events it already sent, e.g. when a durable queue is replayed after a
+// crash. Unlike Mixpanel's own deduplication it isn't limited to recent events.
+// Implementations must be safe for concurrent use
+type IdempotencyStore interface {
+	// Has reports whether an event with the insert ID was sent
+	Has(ctx context.Context, insertID string) (bool, error)
+	// Add records that an event with the insert ID was sent
+	Add(ctx context.Context, insertID string) error
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore that remembers the most recently sent insert IDs
+// of a single process
+type MemoryIdempotencyStore struct {
+	sent *lruCache
+}
+
+// NewMemoryIdempotencyStore returns a MemoryIdempotencyStore remembering up to size insert IDs
+// e.g. `m.IdempotencyStore = mixpanel.NewMemoryIdempotencyStore(100000)`
+func NewMemoryIdempotencyStore(size int) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{sent: newLRUCache(size, 0)}
+}
+
+func (s *MemoryIdempotencyStore) Has(ctx context.Context, insertID string) (bool, error) {
+	_, ok := s.sent.Get(insertID)
+	return ok, nil
+}
+
+func (s *MemoryIdempotencyStore) Add(ctx context.Context, insertID string) error {
+	s.sent.Set(insertID, true)
+	return nil
+}
+
+// unsentEvents returns the events whose $insert_id isn't in the IdempotencyStore
+func (m *Mixpanel) unsentEvents(ctx context.Context, events []Event) ([]Event, error) {
+	if m.IdempotencyStore == nil {
+		return events, nil
+	}
+
+	unsent := make([]Event, 0, len(events))
+	for _, event := range events {
+		insertID, ok := event.Properties["$insert_id"].(string)
+		if ok {
+			sent, err := m.IdempotencyStore.Has(ctx, insertID)
+			if err != nil {
+				return nil, err
+			}
+			if sent {
+				continue
+			}
+		}
+
+		unsent = append(unsent, event)
+	}
+
+	return unsent, nil
+}
+
+// markSent adds the $insert_id of the events to the IdempotencyStore. The events were already
+// sent, so a store that fails is only reported to OnWarning
+func (m *Mixpanel) markSent(ctx context.Context, events []Event) {
+	if m.IdempotencyStore == nil {
+		return
+	}
+
+	for _, event := range events {
+		if insertID, ok := event.Properties["$insert_id"].(string); ok {
+			if err := m.IdempotencyStore.Add(ctx, insertID); err != nil {
+				m.warn(fmt.Sprintf("could not record the $insert_id %q as sent: %v", insertID, err))
+			}
+		}
+	}
+}
@@ -2,69 +2,610 @@
 package mixpanel
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 )
 
-const BASE_URL = "https://api.mixpanel.com"
+const (
+	BASE_URL  = "https://api.mixpanel.com"
+	QUERY_URL = "https://mixpanel.com/api"
+
+	BASE_URL_EU  = "https://api-eu.mixpanel.com"
+	QUERY_URL_EU = "https://eu.mixpanel.com/api"
+
+	BASE_URL_IN  = "https://api-in.mixpanel.com"
+	QUERY_URL_IN = "https://in.mixpanel.com/api"
+)
+
+// Residency is the region a Mixpanel project stores its data in, which decides the hosts it is
+// reached at
+type Residency int
+
+const (
+	// ResidencyUS is the default region, at BASE_URL and QUERY_URL
+	ResidencyUS Residency = iota
+	// ResidencyEU is for projects on EU data residency, at BASE_URL_EU and QUERY_URL_EU
+	ResidencyEU
+	// ResidencyIN is for projects on India data residency, at BASE_URL_IN and QUERY_URL_IN
+	ResidencyIN
+)
+
+// Paths of the ingestion endpoints, relative to BaseURL
+const (
+	trackPath  = "/track/"
+	engagePath = "/engage/"
+	groupsPath = "/groups/"
+	importPath = "/import/"
+)
+
+// tokenValidationEvent is the event ValidateToken sends to check the token
+const tokenValidationEvent = "Token Validation"
+
+const defaultEventTagsProperty = "tags"
+
+// schemaVersionProperty carries SchemaVersion on every event
+const schemaVersionProperty = "schema_version"
+
+const defaultTimedEventTTL = 24 * time.Hour
+
+const (
+	defaultLastEventCacheSize = 10000
+	defaultLastEventTTL       = 30 * time.Minute
+)
+
+// defaultClient sends the requests of clients without a Client, giving up on a hung Mixpanel endpoint
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// The largest request payload sent by default, see MaxPayloadBytes
+const defaultMaxPayloadBytes = 2 * 1024 * 1024
+
+// Mixpanel truncates string property values longer than this many bytes
+const maxStringBytes = 255
 
 var (
 	// This error is returned when Mixpanel returns a non-success message when tracking an event
 	ErrUnexpectedTrackResponse = fmt.Errorf("Unexpected Mixpanel Track Response")
 	// This error is returned when Mixpanel returns a non-success message when using an engage event
 	ErrUnexpectedEngageResponse = fmt.Errorf("Unexpected Mixpanel Engage Response")
+	// This error is returned when Mixpanel returns a non-success message when updating a group profile
+	ErrUnexpectedGroupResponse = fmt.Errorf("Unexpected Mixpanel Group Response")
+	// This error is returned when Mixpanel returns a non-success message from one of the query APIs
+	ErrUnexpectedQueryResponse = fmt.Errorf("Unexpected Mixpanel Query Response")
+	// This error is returned by GetProfile when no profile has the given distinct ID
+	ErrProfileNotFound = fmt.Errorf("Mixpanel Profile Not Found")
+	// This error is returned by the query methods that need a ProjectID when none is set
+	ErrMissingProjectID = fmt.Errorf("Missing Mixpanel Project ID")
+	// This error is returned when a profile operation is given an empty distinct ID
+	ErrEmptyDistinctID = fmt.Errorf("Empty Mixpanel Distinct ID")
+	// This error is returned when Track is given a property its RejectUnknown schema doesn't list
+	ErrUnknownProperty = fmt.Errorf("Unknown Mixpanel Property")
+	// This error is returned when AliasBatch is given the same new ID more than once
+	ErrDuplicateAlias = fmt.Errorf("Duplicate Mixpanel Alias")
+	// This error is returned by the batch methods under RejectDuplicateInsertIDs when two events share an $insert_id
+	ErrDuplicateInsertID = fmt.Errorf("Duplicate Mixpanel Insert ID")
+	// This error is returned when TrackWithLocation is given a latitude or longitude out of range, or not finite
+	ErrInvalidCoordinates = fmt.Errorf("Invalid Mixpanel Coordinates")
+	// This error is returned by ValidateToken when Mixpanel rejects the configured token
+	ErrInvalidToken = fmt.Errorf("Invalid Mixpanel Token")
+	// This error is returned under StrictFloats when an event property is NaN or infinite, which JSON can't encode
+	ErrInvalidFloat = fmt.Errorf("Invalid Mixpanel Float Property")
+	// This error is returned when an event has more than MaxProperties properties and PruneProperties is off
+	ErrTooManyProperties = fmt.Errorf("Too Many Mixpanel Properties")
+	// This error is returned by TrackChargeWithCurrency for a charge outside BaseCurrency when there is no CurrencyConverter
+	ErrMissingCurrencyConverter = fmt.Errorf("Missing Mixpanel Currency Converter")
+	// This error is returned when TrackWithGeo is given a country code that isn't ISO 3166-1 alpha-2
+	ErrInvalidCountryCode = fmt.Errorf("Invalid Mixpanel Country Code")
 )
 
+// verboseResponse is the body returned by the ingestion endpoints when called with verbose=1
+type verboseResponse struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
 type Mixpanel struct {
 	Token             string
 	BaseURL           string
 	OverrideIPAddress string
+
+	// ProfileCacheTTL is how long WithProfileCache remembers each property set on a profile
+	// (defaults to 10 minutes)
+	ProfileCacheTTL time.Duration
+
+	// AllowEmptyDistinctID lets the profile operations send an empty distinct ID instead of
+	// returning ErrEmptyDistinctID
+	AllowEmptyDistinctID bool
+
+	// APISecret authenticates requests to the query APIs (e.g. ProfileCount)
+	APISecret string
+	// ProjectID identifies the project to the query APIs that need it, e.g. QueryInsights
+	ProjectID int
+	// QueryURL is the base URL of the query APIs, which are served from a different host than ingestion
+	QueryURL string
+	// QueryCacheTTL makes the query methods (e.g. ProfileCount) reuse the response to an identical
+	// query made within this long instead of asking Mixpanel again. Zero disables the cache
+	QueryCacheTTL time.Duration
+
+	// IdempotencyStore is consulted before sending events with an $insert_id, skipping the events
+	// it already holds, and updated once they are sent, e.g. with a NewMemoryIdempotencyStore
+	IdempotencyStore IdempotencyStore
+
+	// Retry retries requests that get no response or a 429 or 5xx status (by default they aren't)
+	// e.g. `m.Retry = mixpanel.RetryConfig{MaxAttempts: 4}`
+	Retry RetryConfig
+
+	// Verbose asks Mixpanel to explain the payloads it rejects, returning a *VerboseError that
+	// carries the reason instead of e.g. a bare ErrUnexpectedTrackResponse
+	Verbose bool
+
+	// Client sends the HTTP requests to Mixpanel (defaults to a client with a 10 second timeout)
+	Client *http.Client
+	// Transport replaces the HTTP requests to BaseURL, e.g. with a FileSink
+	Transport Transport
+	// RequestSigner is called with every HTTP request to Mixpanel once its URL, body and headers
+	// are final, just before it is sent, e.g. to add a signature header for an egress proxy
+	RequestSigner func(req *http.Request)
+
+	// MaxPayloadBytes caps the encoded size of a batch sent to Mixpanel; batches are split when
+	// either this or the 50 event limit is reached (defaults to 2MB)
+	MaxPayloadBytes int
+	// DuplicateInsertIDs decides what the batch methods do with events that share an $insert_id
+	// (defaults to AllowDuplicateInsertIDs)
+	DuplicateInsertIDs DuplicateInsertIDPolicy
+
+	// TimedEventTTL is how long a timer started by TimeEvent waits for the matching Track
+	// before it is discarded (defaults to 24 hours)
+	TimedEventTTL time.Duration
+
+	// AdjustClockSkew makes Track stamp events that carry no "time" property with the local clock
+	// corrected by the skew observed against the Date header of Mixpanel's last response
+	AdjustClockSkew bool
+
+	// TimeSource returns the time Track stamps an event with when its properties carry no "time",
+	// e.g. a timestamp embedded in the source record. It takes precedence over AdjustClockSkew,
+	// and returning the zero time leaves it to Mixpanel to use the time it received the event
+	TimeSource func(properties map[string]interface{}) time.Time
+
+	// SetProfileLocation makes TrackWithLocation also $set the coordinates on the user's profile
+	SetProfileLocation bool
+
+	// DistinctIDField is the property Track reads the distinct ID from, e.g. a legacy "user_id". It is
+	// renamed to Mixpanel's "distinct_id" on send when it holds a string or an integer, replacing any
+	// distinct ID already set
+	// (defaults to "$distinct_id", which like "distinct_id" is sent as is)
+	DistinctIDField string
+
+	// ContextExtractors add the properties they find in the context, e.g. a tenant stored by a
+	// middleware, to the events tracked by TrackContext, TrackBatchContext and TrackCritical (Track
+	// and TrackBatch run them on context.Background()). They run in order, a later extractor
+	// overriding an earlier one, properties given explicitly take precedence over all of them, and
+	// nil values are left out
+	// e.g. `m.ContextExtractors = []func(context.Context) map[string]interface{}{tenantProperties}`
+	ContextExtractors []func(ctx context.Context) map[string]interface{}
+
+	// CaptureCaller makes Track send the name of the function that tracked the event as the
+	// "$source_function" property. Walking the stack costs time on every event
+	CaptureCaller bool
+
+	// SchemaVersion is sent as the "schema_version" property of every event, unless the event sets it
+	// itself or is listed in SchemaVersions
+	SchemaVersion string
+	// SchemaVersions overrides SchemaVersion for the events on their own versioning cadence
+	// e.g. `m.SchemaVersions = map[string]string{"Checkout Completed": "3"}`
+	SchemaVersions map[string]string
+
+	// Schemas maps event names to the properties Track allows them to carry
+	// e.g. `m.Schemas = map[string]mixpanel.EventSchema{"Signed Up": {Properties: []string{"plan"}}}`
+	Schemas map[string]EventSchema
+
+	// CoerceStringers makes Track send the String() of property values implementing fmt.Stringer,
+	// e.g. integer enums, unless they implement json.Marshaler
+	CoerceStringers bool
+
+	// TruncateLongStrings makes Track cut string properties down to Mixpanel's 255 byte limit itself,
+	// flagging each one it cut with a "<key>_truncated" property set to true
+	TruncateLongStrings bool
+
+	// EventTags maps event names to tags that Track $union's onto the profile of the user who
+	// performed the event. Each tagged event costs an extra engage request
+	// e.g. `m.EventTags = map[string][]string{"Purchase": {"buyer"}}`
+	EventTags map[string][]string
+	// EventTagsProperty is the list property of the profile that EventTags are added to (defaults to "tags")
+	EventTagsProperty string
+
+	// TrackTimeSinceLastEvent makes Track add "$time_since_last_event", the seconds elapsed since this
+	// client tracked the previous event for the same distinct ID
+	TrackTimeSinceLastEvent bool
+	// LastEventCacheSize bounds how many distinct IDs are remembered for TrackTimeSinceLastEvent,
+	// evicting the least recently active ones first (defaults to 10000)
+	LastEventCacheSize int
+	// LastEventTTL forgets distinct IDs that have been idle for this long (defaults to 30 minutes)
+	LastEventTTL time.Duration
+
+	// EventNameAliases maps event names to additional names Track also sends the event under, e.g.
+	// while an event is being renamed. Each copy shares the distinct ID but gets its own $insert_id
+	// e.g. `m.EventNameAliases = map[string][]string{"Signed Up": {"User Signed Up"}}`
+	EventNameAliases map[string][]string
+
+	// BaseCurrency is the ISO 4217 code of the currency TrackChargeWithCurrency reports revenue in
+	BaseCurrency string
+	// CurrencyConverter converts amount from one currency to another for TrackChargeWithCurrency
+	// e.g. `m.CurrencyConverter = func(amount float64, from, to string) (float64, error) { return amount * rates[from][to], nil }`
+	CurrencyConverter func(amount float64, from, to string) (float64, error)
+
+	// KeyCompressionMap maps event property keys to the shorter keys Track sends them under, to cut
+	// Mixpanel's storage of high volume events. Reserved properties (e.g. "$browser") are never
+	// renamed, and ExpandPropertyKeys reverses the mapping for properties read back from Mixpanel
+	// e.g. `m.KeyCompressionMap = map[string]string{"search_query": "sq", "result_count": "rc"}`
+	KeyCompressionMap map[string]string
+
+	// MaxProperties caps the number of properties Track sends with an event, counting the token;
+	// Mixpanel rejects events with more than 255. Larger events return ErrTooManyProperties unless
+	// PruneProperties is set. Zero doesn't cap the properties
+	MaxProperties int
+	// PruneProperties makes Track send events over MaxProperties with their reserved properties
+	// (e.g. "$insert_id") and the rest of their properties in key order up to the cap, flagged
+	// with a "_properties_pruned" property set to true. Events whose reserved properties alone
+	// don't fit still return ErrTooManyProperties
+	PruneProperties bool
+
+	// StrictFloats makes Track return ErrInvalidFloat for events with NaN or infinite float properties.
+	// By default those properties are dropped, with a warning, and the rest of the event is sent
+	StrictFloats bool
+	// OnWarning is called when Track sends an event with less than it was given, e.g. a dropped property,
+	// with the deprecation notices found in Mixpanel's response headers, and when a Collector can't
+	// make the profile updates of the events it sent
+	OnWarning func(warning string)
+
+	// FirstTouchProperties lists the event properties that are also $set_once on the profile of the
+	// user who performed the event, so the profile keeps the values of their very first event while
+	// each event keeps its own. A tracked event carrying any of them costs an extra engage request
+	// e.g. `m.FirstTouchProperties = []string{"utm_source", "utm_campaign"}`
+	FirstTouchProperties []string
+
+	// OnDeadLetter is called with every event that could not be delivered, so that it can be stored
+	// for inspection or replay. Batch sends call it once per event of each failed batch
+	OnDeadLetter func(e Event, err error)
+
+	// OrderedDelivery makes concurrent Track calls for the same distinct ID reach Mixpanel one at a
+	// time, in the order they were made, e.g. for events whose order matters to a funnel. Events for
+	// different distinct IDs are still sent concurrently
+	OrderedDelivery bool
+
+	// DeviceIDGenerator returns the "$device_id" of each Session started with NewSession
+	// (defaults to a random hex ID)
+	DeviceIDGenerator func() string
+
+	serverMetadata map[string]interface{}
+
+	ordered orderedQueues
+
+	profileCache *lruCache
+
+	timersOnce sync.Once
+	timers     *lruCache
+
+	lastEventsOnce sync.Once
+	lastEvents     *lruCache
+
+	queryCacheOnce sync.Once
+	queryCache     *lruCache
+
+	timezoneMu sync.Mutex
+	timezone   *time.Location
+
+	warmMu sync.Mutex
+	warm   bool
+
+	// the deprecation notices already passed to OnWarning
+	deprecations sync.Map
+
+	clockMu    sync.Mutex
+	serverTime time.Time
+	clockSkew  time.Duration
 }
 
-// NewMixpanelClient returns a Mixpanel struct with which you can perform other Mixpanel operations
+// NewMixpanelClient returns a Mixpanel struct with which you can perform other Mixpanel operations.
+// It takes the project token and, optionally, the base URL to send to instead of BASE_URL, and
+// panics when called without a token or with an empty one
 // e.g. `m := mixpanel.NewMixpanelClient("your_mixpanel_token")`
 func NewMixpanelClient(args ...string) *Mixpanel {
-	var m *Mixpanel
+	if len(args) == 0 || len(args[0]) == 0 {
+		panic("mixpanel: NewMixpanelClient needs a project token")
+	}
 
-	if len(args) == 1 {
-		m = &Mixpanel{Token: args[0], BaseURL: BASE_URL}
-	} else if len(args) > 1 {
-		m = &Mixpanel{Token: args[0], BaseURL: args[1]}
+	m := &Mixpanel{Token: args[0], BaseURL: BASE_URL, QueryURL: QUERY_URL}
+	if len(args) > 1 {
+		m.BaseURL = args[1]
+	}
+
+	return m
+}
+
+// NewMixpanelClientWithResidency is like NewMixpanelClient, but sends to and queries the hosts of
+// the residency's region. It panics on an empty token or an unknown Residency
+// e.g. `m := mixpanel.NewMixpanelClientWithResidency("your_mixpanel_token", mixpanel.ResidencyEU)`
+func NewMixpanelClientWithResidency(token string, residency Residency) *Mixpanel {
+	m := NewMixpanelClient(token)
+
+	switch residency {
+	case ResidencyUS:
+	case ResidencyEU:
+		m.BaseURL, m.QueryURL = BASE_URL_EU, QUERY_URL_EU
+	case ResidencyIN:
+		m.BaseURL, m.QueryURL = BASE_URL_IN, QUERY_URL_IN
+	default:
+		panic(fmt.Sprintf("mixpanel: unknown Residency %d", residency))
 	}
 
 	return m
 }
 
 // Track creates a Mixpanel event for the "event" string along with other properties
-// that are added to the event as meta-data
+// that are added to the event as meta-data. The properties map itself is left as it is, so it
+// can be shared between goroutines
+// A time.Time "time" property is sent as its .UTC().Unix() seconds, whatever its location.
+// Zero time.Time properties are dropped with a warning rather than sent as the year 1, which
+// leaves the event's time to Mixpanel
 // e.g. `err := mc.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})`
 func (m *Mixpanel) Track(event string, properties map[string]interface{}) error {
-	var data map[string]interface{} = make(map[string]interface{})
+	return m.TrackContext(context.Background(), event, properties)
+}
 
-	data["event"] = event
-	properties["token"] = m.Token
-	data["properties"] = properties
+// TrackContext is like Track, but abandons the request when ctx is done. Properties that carry no
+// distinct ID get the one stored in ctx by ContextWithDistinctID, if any, and the ContextExtractors
+// add theirs
+// e.g. `err := mc.TrackContext(ctx, "User Signed Up", map[string]interface{}{"plan": "pro"})`
+func (m *Mixpanel) TrackContext(ctx context.Context, event string, properties map[string]interface{}) error {
+	return m.trackEvent(ctx, event, m.contextProperties(ctx, properties), nil)
+}
+
+// trackEvent implements Track, sending params along with the event in the query string
+func (m *Mixpanel) trackEvent(ctx context.Context, event string, properties map[string]interface{}, params url.Values) error {
+	// before OrderedDelivery hands the event to another goroutine
+	m.captureCaller(properties)
+
+	if distinctID := distinctIDOf(properties); m.OrderedDelivery && len(distinctID) > 0 {
+		return m.ordered.do(distinctID, func() error {
+			return m.deliverEvent(ctx, event, properties, params)
+		})
+	}
+
+	return m.deliverEvent(ctx, event, properties, params)
+}
+
+func (m *Mixpanel) deliverEvent(ctx context.Context, event string, properties map[string]interface{}, params url.Values) error {
+	if err := m.prepareEvent(event, properties); err != nil {
+		return err
+	}
 
-	response, err := m.get(fmt.Sprintf("%s/track/", m.BaseURL), data)
+	var err error
+	if aliases := m.EventNameAliases[event]; len(aliases) > 0 {
+		err = m.trackBatch(ctx, withEventNameAliases(Event{Name: event, Properties: properties}, aliases), params)
+	} else {
+		err = m.track(ctx, event, properties, params)
+	}
 	if err != nil {
 		return err
 	}
 
-	if response != "1" {
-		return ErrUnexpectedTrackResponse
+	return m.updateTrackedProfile(ctx, event, properties)
+}
+
+// prepareEvent checks the event against its schema and completes its properties before sending
+func (m *Mixpanel) prepareEvent(event string, properties map[string]interface{}) error {
+	m.normalizeDistinctID(properties)
+	m.captureCaller(properties)
+
+	if err := m.applySchema(event, properties); err != nil {
+		return err
+	}
+
+	m.prepareProperties(event, properties)
+	if err := m.checkFloats(event, properties); err != nil {
+		return err
+	}
+
+	return m.checkPropertyCount(event, properties)
+}
+
+// updateTrackedProfile makes the profile updates configured for a tracked event
+func (m *Mixpanel) updateTrackedProfile(ctx context.Context, event string, properties map[string]interface{}) error {
+	if err := m.tagProfile(ctx, distinctIDOf(properties), event); err != nil {
+		return err
+	}
+
+	return m.setFirstTouch(ctx, distinctIDOf(properties), properties)
+}
+
+// TrackWithLocation tracks the event for distinctID with the "$latitude" and "$longitude"
+// properties Mixpanel uses to geolocate it. When SetProfileLocation is enabled the
+// coordinates are also $set on the profile, which is a second request
+// e.g. `err := m.TrackWithLocation("1", "Check In", 51.5074, -0.1278, nil)`
+func (m *Mixpanel) TrackWithLocation(distinctID, event string, lat, lng float64, properties map[string]interface{}) error {
+	// NaN fails every comparison, so it needs checking on its own
+	if math.IsNaN(lat) || math.IsNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return ErrInvalidCoordinates
+	}
+
+	properties = copyProperties(properties)
+	properties["distinct_id"] = distinctID
+	properties["$latitude"] = lat
+	properties["$longitude"] = lng
+
+	if err := m.Track(event, properties); err != nil {
+		return err
+	}
+
+	if m.SetProfileLocation {
+		return m.ProfileSet(distinctID, map[string]interface{}{"$latitude": lat, "$longitude": lng})
 	}
 
 	return nil
 }
 
+// TrackAndSet tracks the event for distinctID and $set's profileProperties on their profile.
+// These are still two requests, and both are made even if the first fails; when only one fails
+// its error is returned as is, and when both fail the returned error wraps the two of them
+// e.g. `err := m.TrackAndSet("1", "Plan Upgraded", map[string]interface{}{"from": "free"}, map[string]interface{}{"plan": "pro"})`
+func (m *Mixpanel) TrackAndSet(distinctID, event string, eventProperties, profileProperties map[string]interface{}) error {
+	eventProperties = copyProperties(eventProperties)
+	eventProperties["distinct_id"] = distinctID
+
+	trackErr := m.Track(event, eventProperties)
+
+	var setErr error
+	if len(profileProperties) > 0 {
+		setErr = m.ProfileSet(distinctID, profileProperties)
+	}
+
+	switch {
+	case trackErr != nil && setErr != nil:
+		return fmt.Errorf("Mixpanel track failed (%w) and profile set failed (%w)", trackErr, setErr)
+	case trackErr != nil:
+		return trackErr
+	default:
+		return setErr
+	}
+}
+
+// TimeEvent starts a timer for the event performed by distinctID; the next Track of that event
+// for the same distinct ID carries the elapsed seconds in its "$duration" property.
+// Timers that are never tracked are discarded after TimedEventTTL
+// e.g. `m.TimeEvent("1", "Image Upload")`
+func (m *Mixpanel) TimeEvent(distinctID, event string) {
+	m.eventTimers().Set(timerKey(distinctID, event), time.Now())
+}
+
+// ServerTime returns Mixpanel's clock as reported by the Date header of the last response,
+// or the zero time if no response has been received yet
+func (m *Mixpanel) ServerTime() time.Time {
+	m.clockMu.Lock()
+	defer m.clockMu.Unlock()
+
+	return m.serverTime
+}
+
+// Warmup establishes a pooled connection to BaseURL so that the first real request doesn't pay
+// for DNS resolution and the TLS handshake. It is safe to call concurrently and does nothing
+// once a warmup has succeeded, or when a Transport other than HTTPTransport is set, as nothing is
+// sent to BaseURL then
+// e.g. `err := m.Warmup(ctx)`
+func (m *Mixpanel) Warmup(ctx context.Context) error {
+	m.warmMu.Lock()
+	defer m.warmMu.Unlock()
+
+	if m.warm {
+		return nil
+	}
+	if _, ok := m.Transport.(httpTransport); m.Transport != nil && !ok {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", m.BaseURL, nil)
+	if err != nil {
+		return err
+	}
+	if m.RequestSigner != nil {
+		m.RequestSigner(req)
+	}
+
+	res, err := m.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	// the body has to be drained for the connection to go back into the pool
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+
+	m.warm = true
+	return nil
+}
+
+// ValidateToken checks that Token belongs to a Mixpanel project by tracking a "Token Validation"
+// event and asking Mixpanel for a verbose response. It returns ErrInvalidToken when Mixpanel
+// rejects the token, and the underlying error when Mixpanel can't be reached at all.
+// Note that the validation event is recorded in the project like any other event
+// e.g. `err := m.ValidateToken(ctx)`
+func (m *Mixpanel) ValidateToken(ctx context.Context) error {
+	data := map[string]interface{}{
+		"event":      tokenValidationEvent,
+		"properties": map[string]interface{}{"token": m.Token},
+	}
+
+	response, err := m.send(ctx, trackPath, url.Values{"verbose": {"1"}}, data)
+	if err != nil {
+		return err
+	}
+
+	var verbose verboseResponse
+	if err := json.Unmarshal([]byte(response), &verbose); err != nil {
+		return ErrUnexpectedTrackResponse
+	}
+
+	if verbose.Status == 1 {
+		return nil
+	}
+
+	if strings.Contains(strings.ToLower(verbose.Error), "token") {
+		return ErrInvalidToken
+	}
+
+	return fmt.Errorf("Mixpanel rejected the token validation event: %s", verbose.Error)
+}
+
+// WithServerMetadata makes Track add properties identifying the process that sent each event:
+// "$server_hostname", "$pid" and, unless build is empty, "$build" (e.g. a commit hash).
+// They are resolved once, when WithServerMetadata is called, and don't override properties
+// given to Track. It returns m so it can be chained onto the constructor
+// e.g. `m := mixpanel.NewMixpanelClient("your_mixpanel_token").WithServerMetadata("4f2a9c1")`
+func (m *Mixpanel) WithServerMetadata(build string) *Mixpanel {
+	metadata := map[string]interface{}{"$pid": os.Getpid()}
+	if hostname, err := os.Hostname(); err == nil {
+		metadata["$server_hostname"] = hostname
+	}
+	if len(build) > 0 {
+		metadata["$build"] = build
+	}
+
+	m.serverMetadata = metadata
+	return m
+}
+
 // ProfileSet creates a "People" profile in Mixpanel with a distinctID (which is the primary key)
 // along with properties that are added as meta-data to the profile
 // e.g. `err := m.ProfileSet("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})`
 func (m *Mixpanel) ProfileSet(distinctID string, properties map[string]interface{}) error {
-	return m.engage(distinctID, "$set", properties)
+	return m.ProfileSetContext(context.Background(), distinctID, properties)
+}
+
+// ProfileSetContext is like ProfileSet, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileSetContext(ctx context.Context, distinctID string, properties map[string]interface{}) error {
+	if m.profileSetCached(distinctID, properties) {
+		return nil
+	}
+
+	if err := m.engage(ctx, distinctID, "$set", properties); err != nil {
+		return err
+	}
+
+	m.cacheProfileSet(distinctID, properties)
+	return nil
 }
 
 // ProfileSetOnce sets properties that are not already set in the profile
@@ -72,7 +613,12 @@ func (m *Mixpanel) ProfileSet(distinctID string, properties map[string]interface
 // ip is optional
 // e.g. `err := m.ProfileSetOnce("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})`
 func (m *Mixpanel) ProfileSetOnce(distinctID string, properties map[string]interface{}) error {
-	return m.engage(distinctID, "$set_once", properties)
+	return m.ProfileSetOnceContext(context.Background(), distinctID, properties)
+}
+
+// ProfileSetOnceContext is like ProfileSetOnce, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileSetOnceContext(ctx context.Context, distinctID string, properties map[string]interface{}) error {
+	return m.engage(ctx, distinctID, "$set_once", properties)
 }
 
 // ProfileAdd increments properties by the given amount for the profile
@@ -81,23 +627,48 @@ func (m *Mixpanel) ProfileSetOnce(distinctID string, properties map[string]inter
 // ip is optional
 // e.g. `err := m.ProfileAdd("1", map[string]int{"items_created": 10, "invites_sent": -1})`
 func (m *Mixpanel) ProfileAdd(distinctID string, properties map[string]int) error {
-	return m.engage(distinctID, "$add", properties)
+	return m.ProfileAddContext(context.Background(), distinctID, properties)
+}
+
+// ProfileAddContext is like ProfileAdd, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileAddContext(ctx context.Context, distinctID string, properties map[string]int) error {
+	return m.engage(ctx, distinctID, "$add", properties)
 }
 
 // ProfileAppend appends values to the given properties of the profile
 // that is referenced by the distinctID (which is the primary key)
+// Each value is appended as a single item, so unlike ProfileUnion a large list is never split up
 // ip is optional
 // e.g. `err := m.ProfileAppend("1", map[string]interface{}{"level_ups": "sword obtained", "power_ups": "bubble lead"})`
 func (m *Mixpanel) ProfileAppend(distinctID string, properties map[string]interface{}) error {
-	return m.engage(distinctID, "$append", properties)
+	return m.ProfileAppendContext(context.Background(), distinctID, properties)
+}
+
+// ProfileAppendContext is like ProfileAppend, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileAppendContext(ctx context.Context, distinctID string, properties map[string]interface{}) error {
+	return m.engage(ctx, distinctID, "$append", properties)
 }
 
 // ProfileUnion unions values to the given properties of the profile
 // that is referenced by the distinctID (which is the primary key)
+// Lists too large for a single request (see MaxPayloadBytes) are split across several;
+// since a union ignores the values already present the profile ends up the same, but the
+// requests stop at the first one that fails, leaving only part of the values added
 // ip is optional
 // e.g. `err := m.ProfileUnion("1", map[string]interface{}{"items_purchased": []string{"socks", "shirts"}})`
 func (m *Mixpanel) ProfileUnion(distinctID string, properties map[string]interface{}) error {
-	return m.engage(distinctID, "$union", properties)
+	return m.ProfileUnionContext(context.Background(), distinctID, properties)
+}
+
+// ProfileUnionContext is like ProfileUnion, but abandons the requests when ctx is done
+func (m *Mixpanel) ProfileUnionContext(ctx context.Context, distinctID string, properties map[string]interface{}) error {
+	for _, chunk := range m.chunkUnion(properties) {
+		if err := m.engage(ctx, distinctID, "$union", chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // ProfileUnset unions values to the given properties of the profile
@@ -105,13 +676,23 @@ func (m *Mixpanel) ProfileUnion(distinctID string, properties map[string]interfa
 // ip is optional
 // e.g. `err := m.ProfileUnset("1", []string{"Days Purchased"})`
 func (m *Mixpanel) ProfileUnset(distinctID string, properties []string) error {
-	return m.engage(distinctID, "$unset", properties)
+	return m.ProfileUnsetContext(context.Background(), distinctID, properties)
+}
+
+// ProfileUnsetContext is like ProfileUnset, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileUnsetContext(ctx context.Context, distinctID string, properties []string) error {
+	return m.engage(ctx, distinctID, "$unset", properties)
 }
 
 // ProfileDelete deletes the profile that is referenced by the distinctID
 // e.g. `err := m.ProfileDelete("1")`
 func (m *Mixpanel) ProfileDelete(distinctID string) error {
-	return m.engage(distinctID, "$delete", "")
+	return m.ProfileDeleteContext(context.Background(), distinctID)
+}
+
+// ProfileDeleteContext is like ProfileDelete, but abandons the request when ctx is done
+func (m *Mixpanel) ProfileDeleteContext(ctx context.Context, distinctID string) error {
+	return m.engage(ctx, distinctID, "$delete", "")
 }
 
 // Alias alias'es an old distinct ID with the new distinct ID
@@ -120,7 +701,505 @@ func (m *Mixpanel) ProfileCreateAliasDistinctIdToAlias(oldID, newID string) erro
 	return m.Track("$create_alias", map[string]interface{}{"distinct_id": oldID, "alias": newID})
 }
 
-func (m *Mixpanel) engage(distinctID string, op string, properties interface{}) error {
+// prepareProperties adds the properties Track derives from the client's configuration
+func (m *Mixpanel) prepareProperties(event string, properties map[string]interface{}) {
+	for key, value := range m.serverMetadata {
+		if _, ok := properties[key]; !ok {
+			properties[key] = value
+		}
+	}
+
+	if _, ok := properties[schemaVersionProperty]; !ok {
+		if version, ok := m.SchemaVersions[event]; ok {
+			properties[schemaVersionProperty] = version
+		} else if len(m.SchemaVersion) > 0 {
+			properties[schemaVersionProperty] = m.SchemaVersion
+		}
+	}
+
+	if start, ok := m.eventTimers().Remove(timerKey(distinctIDOf(properties), event)); ok {
+		properties["$duration"] = time.Since(start.(time.Time)).Seconds()
+	}
+
+	m.normalizeTimes(event, properties)
+
+	if _, ok := properties["time"]; !ok {
+		if m.TimeSource != nil {
+			if t := m.TimeSource(properties); !t.IsZero() {
+				properties["time"] = t.Unix()
+			}
+		} else if m.AdjustClockSkew {
+			if skew, ok := m.observedClockSkew(); ok {
+				properties["time"] = time.Now().Add(skew).Unix()
+			}
+		}
+	}
+
+	if distinctID := distinctIDOf(properties); m.TrackTimeSinceLastEvent && len(distinctID) > 0 {
+		now := time.Now()
+		if last, ok := m.lastEventTimes().Get(distinctID); ok {
+			properties["$time_since_last_event"] = now.Sub(last.(time.Time)).Seconds()
+		}
+		m.lastEventTimes().Set(distinctID, now)
+	}
+
+	if m.CoerceStringers {
+		coerceStringers(properties)
+	}
+
+	if m.TruncateLongStrings {
+		truncateLongStrings(properties)
+	}
+
+	if len(m.KeyCompressionMap) > 0 {
+		m.compressKeys(event, properties)
+	}
+}
+
+// normalizeTimes drops the zero time.Time properties and converts the event's "time" to Unix seconds
+func (m *Mixpanel) normalizeTimes(event string, properties map[string]interface{}) {
+	for key, value := range properties {
+		var t time.Time
+		switch value := value.(type) {
+		case time.Time:
+			t = value
+		case *time.Time:
+			if value == nil {
+				continue
+			}
+			t = *value
+		default:
+			continue
+		}
+
+		if t.IsZero() {
+			delete(properties, key)
+			m.warn(fmt.Sprintf("dropped the zero time property %q of the %q event", key, event))
+		} else if key == "time" {
+			properties[key] = t.UTC().Unix()
+		}
+	}
+}
+
+func (m *Mixpanel) compressKeys(event string, properties map[string]interface{}) {
+	compressed := make(map[string]string)
+	for key := range properties {
+		if short, ok := m.KeyCompressionMap[key]; ok && !isReservedProperty(key) {
+			compressed[key] = short
+		}
+	}
+
+	for key, short := range compressed {
+		// don't overwrite a property that is already sent under the short key
+		if _, ok := properties[short]; ok {
+			m.warn(fmt.Sprintf("kept the %q property of the %q event uncompressed, %q is already set", key, event, short))
+			continue
+		}
+
+		properties[short] = properties[key]
+		delete(properties, key)
+	}
+}
+
+// ExpandPropertyKeys returns a copy of properties, e.g. of an event exported from Mixpanel, with
+// the keys shortened by KeyCompressionMap restored to their full names
+// e.g. `properties := m.ExpandPropertyKeys(exported)`
+func (m *Mixpanel) ExpandPropertyKeys(properties map[string]interface{}) map[string]interface{} {
+	full := make(map[string]string, len(m.KeyCompressionMap))
+	for key, short := range m.KeyCompressionMap {
+		full[short] = key
+	}
+
+	expanded := make(map[string]interface{}, len(properties))
+	for key, value := range properties {
+		if fullKey, ok := full[key]; ok {
+			key = fullKey
+		}
+		expanded[key] = value
+	}
+
+	return expanded
+}
+
+// checkFloats drops the NaN and infinite float properties, which json.Marshal refuses to encode,
+// or rejects the event under StrictFloats. Lists and objects are searched as well, and lose their
+// own non-finite elements; the caller's are left untouched
+func (m *Mixpanel) checkFloats(event string, properties map[string]interface{}) error {
+	for key, value := range properties {
+		value, keep, err := m.finiteValue(event, key, value)
+		if err != nil {
+			return err
+		}
+
+		if keep {
+			properties[key] = value
+		} else {
+			delete(properties, key)
+		}
+	}
+
+	return nil
+}
+
+// finiteValue returns value without its non-finite floats for checkFloats, and whether to keep it
+// at all. path names the value in the warnings, e.g. "scores[1]"
+func (m *Mixpanel) finiteValue(event, path string, value interface{}) (interface{}, bool, error) {
+	var f float64
+	switch value := value.(type) {
+	case float64:
+		f = value
+	case float32:
+		f = float64(value)
+	case []interface{}:
+		finite := make([]interface{}, 0, len(value))
+		for i, element := range value {
+			element, keep, err := m.finiteValue(event, fmt.Sprintf("%s[%d]", path, i), element)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				finite = append(finite, element)
+			}
+		}
+		return finite, true, nil
+	case []float64:
+		finite := make([]float64, 0, len(value))
+		for i, element := range value {
+			_, keep, err := m.finiteValue(event, fmt.Sprintf("%s[%d]", path, i), element)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				finite = append(finite, element)
+			}
+		}
+		return finite, true, nil
+	case map[string]interface{}:
+		finite := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			element, keep, err := m.finiteValue(event, path+"."+key, element)
+			if err != nil {
+				return nil, false, err
+			}
+			if keep {
+				finite[key] = element
+			}
+		}
+		return finite, true, nil
+	default:
+		return value, true, nil
+	}
+
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return value, true, nil
+	}
+
+	if m.StrictFloats {
+		return nil, false, ErrInvalidFloat
+	}
+
+	m.warn(fmt.Sprintf("dropped the %v property %q of the %q event", f, path, event))
+	return nil, false, nil
+}
+
+// checkPropertyCount applies MaxProperties to the properties, counting those added once the
+// event is sent
+func (m *Mixpanel) checkPropertyCount(event string, properties map[string]interface{}) error {
+	if m.MaxProperties <= 0 {
+		return nil
+	}
+
+	var added []string
+	if _, ok := properties["token"]; !ok {
+		added = append(added, "token")
+	}
+	if _, ok := properties["$insert_id"]; !ok && len(m.EventNameAliases[event]) > 0 {
+		// given to the alias copies
+		added = append(added, "$insert_id")
+	}
+	if len(properties)+len(added) <= m.MaxProperties {
+		return nil
+	}
+
+	if !m.PruneProperties {
+		return ErrTooManyProperties
+	}
+
+	var reserved, others []string
+	for key := range properties {
+		if key == "token" {
+			continue
+		}
+		if isReservedProperty(key) {
+			reserved = append(reserved, key)
+		} else {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+
+	// leave room for the token, the added properties and the flag
+	keep := m.MaxProperties - len(added) - 1
+	if _, ok := properties["token"]; ok {
+		keep--
+	}
+	if keep < len(reserved) {
+		// the cap is too small for the properties Mixpanel needs
+		return ErrTooManyProperties
+	}
+
+	for _, key := range others[keep-len(reserved):] {
+		delete(properties, key)
+	}
+	properties["_properties_pruned"] = true
+
+	return nil
+}
+
+func (m *Mixpanel) warn(warning string) {
+	if m.OnWarning != nil {
+		m.OnWarning(warning)
+	}
+}
+
+func (m *Mixpanel) track(ctx context.Context, event string, properties map[string]interface{}, params url.Values) error {
+	events, err := m.unsentEvents(ctx, []Event{{Name: event, Properties: properties}})
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	if err := m.sendTrack(ctx, event, properties, params); err != nil {
+		m.deadLetter(events, err)
+		return err
+	}
+
+	m.markSent(ctx, events)
+	return nil
+}
+
+func (m *Mixpanel) sendTrack(ctx context.Context, event string, properties map[string]interface{}, params url.Values) error {
+	var data map[string]interface{} = make(map[string]interface{})
+
+	data["event"] = event
+	properties["token"] = m.Token
+	data["properties"] = properties
+
+	response, err := m.send(ctx, trackPath, params, data)
+	if err != nil {
+		return err
+	}
+
+	return m.checkResponse(response, ErrUnexpectedTrackResponse)
+}
+
+func (m *Mixpanel) deadLetter(events []Event, err error) {
+	if m.OnDeadLetter == nil {
+		return
+	}
+
+	for _, event := range events {
+		m.OnDeadLetter(event, err)
+	}
+}
+
+func (m *Mixpanel) tagProfile(ctx context.Context, distinctID, event string) error {
+	tags := m.EventTags[event]
+	if len(tags) == 0 || len(distinctID) == 0 {
+		return nil
+	}
+
+	property := m.EventTagsProperty
+	if len(property) == 0 {
+		property = defaultEventTagsProperty
+	}
+
+	return m.ProfileUnionContext(ctx, distinctID, map[string]interface{}{property: tags})
+}
+
+func (m *Mixpanel) setFirstTouch(ctx context.Context, distinctID string, properties map[string]interface{}) error {
+	if len(m.FirstTouchProperties) == 0 || len(distinctID) == 0 {
+		return nil
+	}
+
+	firstTouch := make(map[string]interface{})
+	for _, key := range m.FirstTouchProperties {
+		if value, ok := properties[key]; ok {
+			firstTouch[key] = value
+		} else if value, ok := properties[m.KeyCompressionMap[key]]; ok && len(m.KeyCompressionMap[key]) > 0 {
+			// sent under its KeyCompressionMap key, but profiles get the full one
+			firstTouch[key] = value
+		}
+	}
+	if len(firstTouch) == 0 {
+		return nil
+	}
+
+	return m.ProfileSetOnceContext(ctx, distinctID, firstTouch)
+}
+
+func (m *Mixpanel) httpClient() *http.Client {
+	if m.Client != nil {
+		return m.Client
+	}
+
+	return defaultClient
+}
+
+func (m *Mixpanel) maxPayloadBytes() int {
+	if m.MaxPayloadBytes > 0 {
+		return m.MaxPayloadBytes
+	}
+
+	return defaultMaxPayloadBytes
+}
+
+func (m *Mixpanel) eventTimers() *lruCache {
+	m.timersOnce.Do(func() {
+		ttl := m.TimedEventTTL
+		if ttl <= 0 {
+			ttl = defaultTimedEventTTL
+		}
+		m.timers = newLRUCache(0, ttl)
+	})
+
+	return m.timers
+}
+
+func (m *Mixpanel) lastEventTimes() *lruCache {
+	m.lastEventsOnce.Do(func() {
+		size := m.LastEventCacheSize
+		if size <= 0 {
+			size = defaultLastEventCacheSize
+		}
+		ttl := m.LastEventTTL
+		if ttl <= 0 {
+			ttl = defaultLastEventTTL
+		}
+		m.lastEvents = newLRUCache(size, ttl)
+	})
+
+	return m.lastEvents
+}
+
+func timerKey(distinctID, event string) string {
+	return distinctID + "\x00" + event
+}
+
+// normalizeDistinctID moves the distinct ID from DistinctIDField to "distinct_id". Only string and
+// integer IDs are moved; anything else, e.g. nil or a pointer, is left where it is
+func (m *Mixpanel) normalizeDistinctID(properties map[string]interface{}) {
+	switch m.DistinctIDField {
+	case "", "distinct_id", "$distinct_id":
+		return
+	}
+
+	value, ok := properties[m.DistinctIDField]
+	if !ok {
+		return
+	}
+
+	var id string
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.String:
+		id = v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// e.g. numeric user IDs
+		id = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		id = strconv.FormatUint(v.Uint(), 10)
+	default:
+		return
+	}
+
+	delete(properties, m.DistinctIDField)
+	delete(properties, "$distinct_id")
+	properties["distinct_id"] = id
+}
+
+// copyProperties returns a copy of properties, never nil, for the client to complete without
+// touching the caller's map, which may be shared with other goroutines
+func copyProperties(properties map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(properties)+1)
+	for key, value := range properties {
+		copied[key] = value
+	}
+
+	return copied
+}
+
+// distinctIDOf returns the distinct ID carried by a set of event properties
+func distinctIDOf(properties map[string]interface{}) string {
+	for _, key := range []string{"distinct_id", "$distinct_id"} {
+		if id, ok := properties[key].(string); ok {
+			return id
+		}
+	}
+
+	return ""
+}
+
+func (m *Mixpanel) observeServerTime(date string) {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+
+	m.clockMu.Lock()
+	defer m.clockMu.Unlock()
+
+	m.serverTime = serverTime
+	m.clockSkew = serverTime.Sub(time.Now())
+}
+
+func (m *Mixpanel) observedClockSkew() (time.Duration, bool) {
+	m.clockMu.Lock()
+	defer m.clockMu.Unlock()
+
+	return m.clockSkew, !m.serverTime.IsZero()
+}
+
+func coerceStringers(properties map[string]interface{}) {
+	for key, value := range properties {
+		// values that choose their own JSON encoding, like time.Time, are left to it
+		if _, ok := value.(json.Marshaler); ok {
+			continue
+		}
+
+		if stringer, ok := value.(fmt.Stringer); ok {
+			properties[key] = stringer.String()
+		}
+	}
+}
+
+func truncateLongStrings(properties map[string]interface{}) {
+	truncated := make(map[string]string)
+
+	for key, value := range properties {
+		if str, ok := value.(string); ok && len(str) > maxStringBytes {
+			cut := maxStringBytes
+			// don't split a multi-byte character
+			for cut > 0 && !utf8.RuneStart(str[cut]) {
+				cut--
+			}
+			truncated[key] = str[:cut]
+		}
+	}
+
+	for key, value := range truncated {
+		properties[key] = value
+		properties[key+"_truncated"] = true
+	}
+}
+
+func (m *Mixpanel) engage(ctx context.Context, distinctID string, op string, properties interface{}) error {
+	if len(distinctID) == 0 && !m.AllowEmptyDistinctID {
+		return ErrEmptyDistinctID
+	}
+
+	if op != "$set" {
+		m.forgetProfile(distinctID)
+	}
+
 	var data map[string]interface{} = make(map[string]interface{})
 
 	data["$token"] = m.Token
@@ -130,33 +1209,90 @@ func (m *Mixpanel) engage(distinctID string, op string, properties interface{})
 	}
 	data[op] = properties
 
-	response, err := m.get(fmt.Sprintf("%s/engage/", m.BaseURL), data)
+	response, err := m.send(ctx, engagePath, nil, data)
 	if err != nil {
 		return err
 	}
 
-	if response != "1" {
-		return ErrUnexpectedEngageResponse
+	return m.checkResponse(response, ErrUnexpectedEngageResponse)
+}
+
+// send delivers the data to the ingestion endpoint at path through Transport, or over HTTP
+func (m *Mixpanel) send(ctx context.Context, path string, params url.Values, data interface{}) (string, error) {
+	transport := m.Transport
+	if transport == nil {
+		transport = httpTransport{m: m}
 	}
 
-	return nil
+	return transport.Send(ctx, path, m.withVerbose(params), data)
 }
 
-func (m *Mixpanel) get(url string, data map[string]interface{}) (string, error) {
+// post sends the data to the endpoint at path on BaseURL as a form body, where its size isn't
+// bound by URL length limits, along with the params in the query string. Transient failures
+// are retried according to Retry.
+// Requests to the import API are authenticated with APISecret
+func (m *Mixpanel) post(ctx context.Context, path string, params url.Values, data interface{}) (string, error) {
 	jsonedData, err := json.Marshal(data)
 	if err != nil {
 		return "", err
 	}
 
-	base64JSONData := base64.StdEncoding.EncodeToString(jsonedData)
+	form := url.Values{}
+	form.Set("data", base64.StdEncoding.EncodeToString(jsonedData))
+
+	endpoint := m.BaseURL + path
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+
+	retry := m.retryConfig(ctx)
+	for attempt := 1; ; attempt++ {
+		res, response, err := m.postOnce(ctx, path, endpoint, form.Encode())
 
-	res, err := http.Get(fmt.Sprintf("%s?data=%s", url, base64JSONData))
+		var header http.Header
+		if err != nil {
+			if ctx.Err() != nil || attempt >= retry.maxAttempts() || !retryable(0, data) {
+				return "", err
+			}
+		} else if attempt >= retry.maxAttempts() {
+			return response, nil
+		} else if retryable(res.StatusCode, data) {
+			header = res.Header
+		} else if res.StatusCode != http.StatusOK || params.Get("verbose") != "1" || !retry.retryableError(response) {
+			return response, nil
+		}
+
+		select {
+		case <-time.After(retry.delay(attempt, header)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+func (m *Mixpanel) postOnce(ctx context.Context, path, endpoint, body string) (*http.Response, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(body))
 	if err != nil {
-		return "", err
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if path == importPath {
+		req.SetBasicAuth(m.APISecret, "")
+	}
+	if m.RequestSigner != nil {
+		m.RequestSigner(req)
+	}
+
+	res, err := m.httpClient().Do(req)
+	if err != nil {
+		return nil, "", err
 	}
 	defer res.Body.Close()
 
+	m.observeServerTime(res.Header.Get("Date"))
+	m.observeDeprecation(path, res.Header)
+
 	responseBody, err := ioutil.ReadAll(res.Body)
 
-	return string(responseBody), err
+	return res, string(responseBody), err
 }
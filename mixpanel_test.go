@@ -2,11 +2,22 @@ package mixpanel_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/nitrous-io/go-mixpanel"
 	. "github.com/onsi/ginkgo"
@@ -14,6 +25,28 @@ import (
 	"github.com/onsi/gomega/ghttp"
 )
 
+type status int
+
+type failingStore struct{}
+
+func (failingStore) Has(ctx context.Context, insertID string) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func (failingStore) Add(ctx context.Context, insertID string) error {
+	return errors.New("store unavailable")
+}
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func (s status) String() string {
+	return [...]string{"inactive", "active"}[s]
+}
+
 func TestContext(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "mixpanel")
@@ -42,9 +75,8 @@ var _ = Describe("mixpanel", func() {
 		var verifier http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 			Expect(r.Method).To(Equal(method))
 			Expect(r.RequestURI).To(MatchRegexp(uriRegexp))
-			url, err := url.ParseRequestURI(r.RequestURI)
-			Expect(err).To(BeNil())
-			data := decodeBase64(url.Query().Get("data"))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/x-www-form-urlencoded"))
+			data := decodeBase64(r.PostFormValue("data"))
 			Expect(data).To(MatchJSON(expectedData))
 			fmt.Fprint(w, responseData)
 		}
@@ -52,12 +84,57 @@ var _ = Describe("mixpanel", func() {
 		server.AppendHandlers(verifier)
 	}
 
+	captureRequestData := func(server *ghttp.Server, responseData string) map[string]interface{} {
+		captured := map[string]interface{}{}
+		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &captured)).To(Succeed())
+			fmt.Fprint(w, responseData)
+		}
+
+		server.AppendHandlers(handler)
+		return captured
+	}
+
+	captureBatchData := func(server *ghttp.Server, responseData string) *[]map[string]interface{} {
+		captured := []map[string]interface{}{}
+		var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &captured)).To(Succeed())
+			fmt.Fprint(w, responseData)
+		}
+
+		server.AppendHandlers(handler)
+		return &captured
+	}
+
+	verifyQueryResponse := func(server *ghttp.Server, path string, expectedQuery url.Values, responseStatus int, responseData string) {
+		var verifier http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.Method).To(Equal("GET"))
+			Expect(r.URL.Path).To(Equal(path))
+			Expect(r.URL.Query()).To(Equal(expectedQuery))
+			user, _, ok := r.BasicAuth()
+			Expect(ok).To(BeTrue())
+			Expect(user).To(Equal("secret"))
+			w.WriteHeader(responseStatus)
+			fmt.Fprint(w, responseData)
+		}
+
+		server.AppendHandlers(verifier)
+	}
+
+	newQueryClient := func() *mixpanel.Mixpanel {
+		m := mixpanel.NewMixpanelClient("token", baseURL)
+		m.APISecret = "secret"
+		m.QueryURL = baseURL
+		return m
+	}
+
 	Describe("NewMixpanelClient", func() {
 		Context("with just a token", func() {
 			It("should initialize a Mixpanel struct with the default base URL", func() {
 				m := mixpanel.NewMixpanelClient("token")
 				Expect(m.Token).To(Equal("token"))
 				Expect(m.BaseURL).To(Equal(mixpanel.BASE_URL))
+				Expect(m.QueryURL).To(Equal(mixpanel.QUERY_URL))
 			})
 		})
 
@@ -68,14 +145,52 @@ var _ = Describe("mixpanel", func() {
 				Expect(m.BaseURL).To(Equal("http://localhost:3000"))
 			})
 		})
+
+		Context("without a token", func() {
+			It("should panic", func() {
+				Expect(func() { mixpanel.NewMixpanelClient() }).To(Panic())
+			})
+		})
+
+		Context("with an empty token", func() {
+			It("should panic", func() {
+				Expect(func() { mixpanel.NewMixpanelClient("") }).To(Panic())
+				Expect(func() { mixpanel.NewMixpanelClient("", "http://localhost:3000") }).To(Panic())
+			})
+		})
+	})
+
+	Describe("NewMixpanelClientWithResidency", func() {
+		It("should use the hosts of the residency", func() {
+			m := mixpanel.NewMixpanelClientWithResidency("token", mixpanel.ResidencyUS)
+			Expect(m.Token).To(Equal("token"))
+			Expect(m.BaseURL).To(Equal(mixpanel.BASE_URL))
+			Expect(m.QueryURL).To(Equal(mixpanel.QUERY_URL))
+
+			m = mixpanel.NewMixpanelClientWithResidency("token", mixpanel.ResidencyEU)
+			Expect(m.BaseURL).To(Equal("https://api-eu.mixpanel.com"))
+			Expect(m.QueryURL).To(Equal("https://eu.mixpanel.com/api"))
+
+			m = mixpanel.NewMixpanelClientWithResidency("token", mixpanel.ResidencyIN)
+			Expect(m.BaseURL).To(Equal("https://api-in.mixpanel.com"))
+			Expect(m.QueryURL).To(Equal("https://in.mixpanel.com/api"))
+		})
+
+		It("should panic on an unknown residency", func() {
+			Expect(func() { mixpanel.NewMixpanelClientWithResidency("token", mixpanel.Residency(42)) }).To(Panic())
+		})
+
+		It("should panic on an empty token", func() {
+			Expect(func() { mixpanel.NewMixpanelClientWithResidency("", mixpanel.ResidencyEU) }).To(Panic())
+		})
 	})
 
 	Describe("Track", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/track\/\?data=.*?\z`,
+					"POST",
+					`\A\/track\/\z`,
 					`{"event":"User Signed Up","properties":{"$distinct_id":"1","token":"token"}}`,
 					"1",
 				)
@@ -92,8 +207,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/track\/\?data=.*?\z`,
+					"POST",
+					`\A\/track\/\z`,
 					`{"event":"User Signed Up","properties":{"$distinct_id":"1","token":"token"}}`,
 					"error",
 				)
@@ -106,14 +221,51 @@ var _ = Describe("mixpanel", func() {
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
+
+		Context("when called from many goroutines", func() {
+			It("should leave the shared properties maps unchanged", func() {
+				var mu sync.Mutex
+				var requests int
+				concurrent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					mu.Lock()
+					requests++
+					mu.Unlock()
+
+					fmt.Fprint(w, "1")
+				}))
+				defer concurrent.Close()
+
+				m := mixpanel.NewMixpanelClient("token", concurrent.URL)
+				m.OverrideIPAddress = "10.0.0.1"
+				eventProperties := map[string]interface{}{"$distinct_id": "1", "plan": "pro"}
+				profileProperties := map[string]interface{}{"plan": "pro"}
+
+				var wg sync.WaitGroup
+				for i := 0; i < 50; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						Expect(m.Track("User Signed Up", eventProperties)).To(Succeed())
+						Expect(m.ProfileSet("1", profileProperties)).To(Succeed())
+					}()
+				}
+				wg.Wait()
+
+				Expect(eventProperties).To(Equal(map[string]interface{}{"$distinct_id": "1", "plan": "pro"}))
+				Expect(profileProperties).To(Equal(map[string]interface{}{"plan": "pro"}))
+				Expect(requests).To(Equal(100))
+			})
+		})
 	})
 
-	Describe("CreateProfile", func() {
+	Describe("ProfileSet", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$set":{"full_name": "Mclovin", "Company": "Acme Organ Donation"}}`,
 					"1",
 				)
@@ -121,7 +273,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.CreateProfile("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
+				err := m.ProfileSet("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -130,8 +282,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$set":{"full_name": "Mclovin", "Company": "Acme Organ Donation"}}`,
 					"error",
 				)
@@ -139,19 +291,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.CreateProfile("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
+				err := m.ProfileSet("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("SetPropertiesOnProfileOnce", func() {
+	Describe("ProfileSetOnce", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$set_once":{"full_name": "Mclovin", "Company": "Acme Organ Donation"}}`,
 					"1",
 				)
@@ -159,7 +311,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.SetPropertiesOnProfileOnce("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
+				err := m.ProfileSetOnce("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -168,8 +320,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$set_once":{"full_name": "Mclovin", "Company": "Acme Organ Donation"}}`,
 					"error",
 				)
@@ -177,19 +329,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.SetPropertiesOnProfileOnce("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
+				err := m.ProfileSetOnce("1", map[string]interface{}{"full_name": "Mclovin", "Company": "Acme Organ Donation"})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("IncrementPropertiesOnProfile", func() {
+	Describe("ProfileAdd", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$add":{"items_created": 10, "invites_sent": -1}}`,
 					"1",
 				)
@@ -197,7 +349,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.IncrementPropertiesOnProfile("1", map[string]int{"items_created": 10, "invites_sent": -1})
+				err := m.ProfileAdd("1", map[string]int{"items_created": 10, "invites_sent": -1})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -206,8 +358,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$add":{"items_created": 10, "invites_sent": -1}}`,
 					"error",
 				)
@@ -215,19 +367,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.IncrementPropertiesOnProfile("1", map[string]int{"items_created": 10, "invites_sent": -1})
+				err := m.ProfileAdd("1", map[string]int{"items_created": 10, "invites_sent": -1})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("AppendPropertiesOnProfile", func() {
+	Describe("ProfileAppend", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$append":{"level_ups": "sword obtained", "power_ups": "bubble lead"}}`,
 					"1",
 				)
@@ -235,7 +387,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.AppendPropertiesOnProfile("1", map[string]interface{}{"level_ups": "sword obtained", "power_ups": "bubble lead"})
+				err := m.ProfileAppend("1", map[string]interface{}{"level_ups": "sword obtained", "power_ups": "bubble lead"})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -244,8 +396,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$append":{"level_ups": "sword obtained", "power_ups": "bubble lead"}}`,
 					"error",
 				)
@@ -253,19 +405,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.AppendPropertiesOnProfile("1", map[string]interface{}{"level_ups": "sword obtained", "power_ups": "bubble lead"})
+				err := m.ProfileAppend("1", map[string]interface{}{"level_ups": "sword obtained", "power_ups": "bubble lead"})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("UnionPropertiesOnProfile", func() {
+	Describe("ProfileUnion", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$union":{"items_purchased": ["socks", "shirts"]}}`,
 					"1",
 				)
@@ -273,7 +425,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.UnionPropertiesOnProfile("1", map[string]interface{}{"items_purchased": []string{"socks", "shirts"}})
+				err := m.ProfileUnion("1", map[string]interface{}{"items_purchased": []string{"socks", "shirts"}})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -282,8 +434,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$union":{"items_purchased": ["socks", "shirts"]}}`,
 					"error",
 				)
@@ -291,19 +443,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.UnionPropertiesOnProfile("1", map[string]interface{}{"items_purchased": []string{"socks", "shirts"}})
+				err := m.ProfileUnion("1", map[string]interface{}{"items_purchased": []string{"socks", "shirts"}})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("UnsetPropertiesOnProfile", func() {
+	Describe("ProfileUnset", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$unset":["Days Purchased"]}`,
 					"1",
 				)
@@ -311,7 +463,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.UnsetPropertiesOnProfile("1", []string{"Days Purchased"})
+				err := m.ProfileUnset("1", []string{"Days Purchased"})
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -320,8 +472,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$unset":["Days Purchased"]}`,
 					"error",
 				)
@@ -329,19 +481,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.UnsetPropertiesOnProfile("1", []string{"Days Purchased"})
+				err := m.ProfileUnset("1", []string{"Days Purchased"})
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("DeleteProfile", func() {
+	Describe("ProfileDelete", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$delete":""}`,
 					"1",
 				)
@@ -349,7 +501,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the user profile along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.DeleteProfile("1")
+				err := m.ProfileDelete("1")
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -358,8 +510,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/engage\/\?data=.*?\z`,
+					"POST",
+					`\A\/engage\/\z`,
 					`{"$token":"token","$distinct_id":"1","$delete":""}`,
 					"error",
 				)
@@ -367,19 +519,19 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.DeleteProfile("1")
+				err := m.ProfileDelete("1")
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
 
-	Describe("Alias", func() {
+	Describe("ProfileCreateAliasDistinctIdToAlias", func() {
 		Context("when mixpanel responds with a valid response", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/track\/\?data=.*?\z`,
+					"POST",
+					`\A\/track\/\z`,
 					`{"event":"$create_alias","properties":{"token": "token", "distinct_id":"deadbeef","alias":"1"}}`,
 					"1",
 				)
@@ -387,7 +539,7 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.Alias("deadbeef", "1")
+				err := m.ProfileCreateAliasDistinctIdToAlias("deadbeef", "1")
 				Expect(err).To(BeNil())
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
@@ -396,8 +548,8 @@ var _ = Describe("mixpanel", func() {
 		Context("when mixpanel responds with an error", func() {
 			BeforeEach(func() {
 				verifyRequestResponse(server,
-					"GET",
-					`\A\/track\/\?data=.*?\z`,
+					"POST",
+					`\A\/track\/\z`,
 					`{"event":"$create_alias","properties":{"token": "token", "distinct_id":"deadbeef","alias":"1"}}`,
 					"error",
 				)
@@ -405,10 +557,2971 @@ var _ = Describe("mixpanel", func() {
 
 			It("should send an base64 encoded version of the event along with the corresponding properties", func() {
 				m := mixpanel.NewMixpanelClient("token", baseURL)
-				err := m.Alias("deadbeef", "1")
+				err := m.ProfileCreateAliasDistinctIdToAlias("deadbeef", "1")
 				Expect(err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
 				Expect(server.ReceivedRequests()).Should(HaveLen(1))
 			})
 		})
 	})
+
+	Describe("ProfileCount", func() {
+		Context("when mixpanel responds with a valid response", func() {
+			BeforeEach(func() {
+				verifyQueryResponse(server,
+					"/2.0/engage/",
+					url.Values{"page": {"0"}, "where": {`properties["plan"] == "pro"`}},
+					http.StatusOK,
+					`{"page":0,"page_size":1000,"session_id":"abc","status":"ok","total":42,"results":[]}`,
+				)
+			})
+
+			It("should return the total number of matching profiles", func() {
+				m := newQueryClient()
+				count, err := m.ProfileCount(context.Background(), `properties["plan"] == "pro"`)
+				Expect(err).To(BeNil())
+				Expect(count).To(Equal(42))
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+
+		Context("when mixpanel responds with an error", func() {
+			BeforeEach(func() {
+				verifyQueryResponse(server,
+					"/2.0/engage/",
+					url.Values{"page": {"0"}},
+					http.StatusBadRequest,
+					`{"error":"bad where clause","request":"/api/2.0/engage/"}`,
+				)
+			})
+
+			It("should return ErrUnexpectedQueryResponse", func() {
+				m := newQueryClient()
+				_, err := m.ProfileCount(context.Background(), "")
+				Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("TimeEvent", func() {
+		It("should add the elapsed $duration to the next matching Track", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TimeEvent("1", "Image Upload")
+			err := m.Track("Image Upload", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(BeNil())
+			properties := data["properties"].(map[string]interface{})
+			Expect(properties).To(HaveKey("$duration"))
+			Expect(properties["$duration"]).To(BeNumerically(">=", 0))
+		})
+
+		It("should only time the distinct ID that started the timer", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TimeEvent("1", "Image Upload")
+			err := m.Track("Image Upload", map[string]interface{}{"$distinct_id": "2"})
+			Expect(err).To(BeNil())
+			Expect(data["properties"]).NotTo(HaveKey("$duration"))
+		})
+
+		It("should discard timers older than TimedEventTTL", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TimedEventTTL = time.Millisecond
+			m.TimeEvent("1", "Image Upload")
+			time.Sleep(5 * time.Millisecond)
+			err := m.Track("Image Upload", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(BeNil())
+			Expect(data["properties"]).NotTo(HaveKey("$duration"))
+		})
+	})
+
+	Describe("AliasBatch", func() {
+		aliasPairs := func(n int) []mixpanel.AliasPair {
+			pairs := make([]mixpanel.AliasPair, n)
+			for i := range pairs {
+				pairs[i] = mixpanel.AliasPair{OldID: fmt.Sprintf("old-%d", i), NewID: fmt.Sprintf("new-%d", i)}
+			}
+			return pairs
+		}
+
+		Context("when mixpanel responds with a valid response", func() {
+			It("should send the $create_alias events in batches of 50", func() {
+				first := captureBatchData(server, "1")
+				second := captureBatchData(server, "1")
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				err := m.AliasBatch(aliasPairs(51))
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+				Expect(*first).To(HaveLen(50))
+				Expect(*second).To(HaveLen(1))
+				Expect((*second)[0]).To(Equal(map[string]interface{}{
+					"event":      "$create_alias",
+					"properties": map[string]interface{}{"token": "token", "distinct_id": "old-50", "alias": "new-50"},
+				}))
+			})
+		})
+
+		Context("when mixpanel responds with an error for one batch", func() {
+			It("should send the remaining batches and report the failed one", func() {
+				captureBatchData(server, "0")
+				captureBatchData(server, "1")
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				err := m.AliasBatch(aliasPairs(51))
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(ContainSubstring("batch 0"))
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+
+				var batchErr *mixpanel.BatchError
+				Expect(errors.As(err, &batchErr)).To(BeTrue())
+				Expect(batchErr.Errors()).To(HaveLen(1))
+				Expect(batchErr.Errors()[0].Index).To(Equal(0))
+				Expect(batchErr.Errors()[0].Err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+				Expect(batchErr.Errors()[0].Events).To(HaveLen(50))
+			})
+		})
+
+		Context("when the events would exceed MaxPayloadBytes", func() {
+			It("should split the batches by size before reaching 50 events", func() {
+				batches := []*[]map[string]interface{}{}
+				for i := 0; i < 5; i++ {
+					batches = append(batches, captureBatchData(server, "1"))
+				}
+				pairs := aliasPairs(10)
+				for i := range pairs {
+					pairs[i].NewID = strings.Repeat("x", 300) + pairs[i].NewID
+				}
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.MaxPayloadBytes = 1200
+				err := m.AliasBatch(pairs)
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(5))
+				for _, batch := range batches {
+					Expect(*batch).To(HaveLen(2))
+				}
+			})
+
+			It("should send an event larger than the limit on its own", func() {
+				first := captureBatchData(server, "1")
+				second := captureBatchData(server, "1")
+				third := captureBatchData(server, "1")
+				pairs := aliasPairs(3)
+				pairs[1].NewID = strings.Repeat("x", 2000)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.MaxPayloadBytes = 1200
+				err := m.AliasBatch(pairs)
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(3))
+				Expect(*first).To(HaveLen(1))
+				Expect(*second).To(HaveLen(1))
+				Expect((*second)[0]["properties"]).To(HaveKeyWithValue("alias", pairs[1].NewID))
+				Expect(*third).To(HaveLen(1))
+			})
+		})
+
+		Context("when a new ID is aliased more than once", func() {
+			It("should return ErrDuplicateAlias without sending anything", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				err := m.AliasBatch([]mixpanel.AliasPair{{OldID: "a", NewID: "1"}, {OldID: "b", NewID: "1"}})
+				Expect(err).To(Equal(mixpanel.ErrDuplicateAlias))
+				Expect(server.ReceivedRequests()).Should(HaveLen(0))
+			})
+		})
+	})
+
+	Describe("ServerTime", func() {
+		var serverTime time.Time
+		var tracked map[string]interface{}
+
+		BeforeEach(func() {
+			serverTime = time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				tracked = map[string]interface{}{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &tracked)).To(Succeed())
+				w.Header().Set("Date", serverTime.Format(http.TimeFormat))
+				fmt.Fprint(w, "1")
+			})
+		})
+
+		It("should be zero before any response is received", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.ServerTime().IsZero()).To(BeTrue())
+		})
+
+		It("should return the time reported by the last response's Date header", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(BeNil())
+			Expect(m.ServerTime()).To(BeTemporally("==", serverTime))
+		})
+
+		Context("with AdjustClockSkew", func() {
+			It("should stamp events with the skew-corrected time", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.AdjustClockSkew = true
+				Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+				Expect(tracked["properties"]).NotTo(HaveKey("time"))
+
+				Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+				Expect(tracked["properties"]).To(HaveKeyWithValue("time", BeNumerically("~", serverTime.Unix(), 2)))
+			})
+
+			It("should leave an explicit time alone", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.AdjustClockSkew = true
+				Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+
+				Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1", "time": 1000})).To(Succeed())
+				Expect(tracked["properties"]).To(HaveKeyWithValue("time", BeNumerically("==", 1000)))
+			})
+		})
+	})
+
+	Describe("TrackWithLocation", func() {
+		Context("with valid coordinates", func() {
+			BeforeEach(func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Check In","properties":{"distinct_id":"1","$latitude":51.5,"$longitude":-0.1,"venue":"pub","token":"token"}}`,
+					"1",
+				)
+			})
+
+			It("should send the coordinates as event properties", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				err := m.TrackWithLocation("1", "Check In", 51.5, -0.1, map[string]interface{}{"venue": "pub"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+
+			Context("with SetProfileLocation", func() {
+				BeforeEach(func() {
+					verifyRequestResponse(server,
+						"POST",
+						`\A\/engage\/\z`,
+						`{"$token":"token","$distinct_id":"1","$set":{"$latitude":51.5,"$longitude":-0.1}}`,
+						"1",
+					)
+				})
+
+				It("should also set the coordinates on the profile", func() {
+					m := mixpanel.NewMixpanelClient("token", baseURL)
+					m.SetProfileLocation = true
+					err := m.TrackWithLocation("1", "Check In", 51.5, -0.1, map[string]interface{}{"venue": "pub"})
+					Expect(err).To(BeNil())
+					Expect(server.ReceivedRequests()).Should(HaveLen(2))
+				})
+			})
+		})
+
+		Context("with coordinates out of range", func() {
+			It("should return ErrInvalidCoordinates without sending anything", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				Expect(m.TrackWithLocation("1", "Check In", 91, 0, nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(m.TrackWithLocation("1", "Check In", 0, -181, nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(server.ReceivedRequests()).Should(HaveLen(0))
+			})
+		})
+
+		Context("with coordinates that aren't finite", func() {
+			It("should return ErrInvalidCoordinates without sending anything", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				Expect(m.TrackWithLocation("1", "Check In", math.NaN(), 0, nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(m.TrackWithLocation("1", "Check In", 0, math.NaN(), nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(m.TrackWithLocation("1", "Check In", math.Inf(1), 0, nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(m.TrackWithLocation("1", "Check In", 0, math.Inf(-1), nil)).To(Equal(mixpanel.ErrInvalidCoordinates))
+				Expect(server.ReceivedRequests()).Should(HaveLen(0))
+			})
+		})
+	})
+
+	Describe("Warmup", func() {
+		BeforeEach(func() {
+			server.RouteToHandler("HEAD", "/", ghttp.RespondWith(http.StatusOK, ""))
+		})
+
+		It("should make a single request to Mixpanel however often it is called", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.Warmup(context.Background())).To(Succeed())
+			Expect(m.Warmup(context.Background())).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should return the error when Mixpanel can't be reached", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			server.Close()
+			Expect(m.Warmup(context.Background())).NotTo(Succeed())
+		})
+
+		It("should do nothing when the payloads go through another Transport", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Transport = mixpanel.NewFileSink(new(bytes.Buffer))
+			Expect(m.Warmup(context.Background())).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("should warm up the connection of HTTPTransport", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Transport = mixpanel.HTTPTransport(m)
+			Expect(m.Warmup(context.Background())).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("TruncateLongStrings", func() {
+		It("should truncate long strings to 255 bytes and flag them", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TruncateLongStrings = true
+			err := m.Track("Search", map[string]interface{}{"$distinct_id": "1", "query": strings.Repeat("a", 300), "page": "home"})
+			Expect(err).To(BeNil())
+			properties := data["properties"].(map[string]interface{})
+			Expect(properties["query"]).To(Equal(strings.Repeat("a", 255)))
+			Expect(properties["query_truncated"]).To(BeTrue())
+			Expect(properties["page"]).To(Equal("home"))
+			Expect(properties).NotTo(HaveKey("page_truncated"))
+		})
+
+		It("should not split multi-byte characters", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TruncateLongStrings = true
+			err := m.Track("Search", map[string]interface{}{"$distinct_id": "1", "query": strings.Repeat("é", 200)})
+			Expect(err).To(BeNil())
+			properties := data["properties"].(map[string]interface{})
+			Expect(properties["query"]).To(Equal(strings.Repeat("é", 127)))
+		})
+
+		It("should leave long strings alone when disabled", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.Track("Search", map[string]interface{}{"$distinct_id": "1", "query": strings.Repeat("a", 300)})
+			Expect(err).To(BeNil())
+			properties := data["properties"].(map[string]interface{})
+			Expect(properties["query"]).To(HaveLen(300))
+			Expect(properties).NotTo(HaveKey("query_truncated"))
+		})
+	})
+
+	Describe("EventTags", func() {
+		BeforeEach(func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Purchase","properties":{"$distinct_id":"1","token":"token"}}`,
+				"1",
+			)
+		})
+
+		Context("when the event is tagged", func() {
+			It("should union the tags onto the profile", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/engage\/\z`,
+					`{"$token":"token","$distinct_id":"1","$union":{"tags":["buyer"]}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.EventTags = map[string][]string{"Purchase": {"buyer"}}
+				err := m.Track("Purchase", map[string]interface{}{"$distinct_id": "1"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+			})
+
+			It("should use EventTagsProperty when set", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/engage\/\z`,
+					`{"$token":"token","$distinct_id":"1","$union":{"segments":["buyer"]}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.EventTags = map[string][]string{"Purchase": {"buyer"}}
+				m.EventTagsProperty = "segments"
+				err := m.Track("Purchase", map[string]interface{}{"$distinct_id": "1"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+			})
+		})
+
+		Context("when the event is not tagged", func() {
+			It("should only track the event", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.EventTags = map[string][]string{"Refund": {"refunded"}}
+				err := m.Track("Purchase", map[string]interface{}{"$distinct_id": "1"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("ValidateToken", func() {
+		respondVerbose := func(body string) {
+			var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/track/"))
+				Expect(r.URL.Query().Get("verbose")).To(Equal("1"))
+				data := decodeBase64(r.PostFormValue("data"))
+				Expect(data).To(MatchJSON(`{"event":"Token Validation","properties":{"token":"token"}}`))
+				fmt.Fprint(w, body)
+			}
+			server.AppendHandlers(handler)
+		}
+
+		Context("when mixpanel accepts the token", func() {
+			It("should return nil", func() {
+				respondVerbose(`{"status":1,"error":null}`)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				Expect(m.ValidateToken(context.Background())).To(Succeed())
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+
+		Context("when mixpanel rejects the token", func() {
+			It("should return ErrInvalidToken", func() {
+				respondVerbose(`{"status":0,"error":"token, missing or empty"}`)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				Expect(m.ValidateToken(context.Background())).To(Equal(mixpanel.ErrInvalidToken))
+			})
+		})
+
+		Context("when mixpanel rejects the event for another reason", func() {
+			It("should return the error reported by mixpanel", func() {
+				respondVerbose(`{"status":0,"error":"data, missing or empty"}`)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				err := m.ValidateToken(context.Background())
+				Expect(err).NotTo(Equal(mixpanel.ErrInvalidToken))
+				Expect(err.Error()).To(ContainSubstring("data, missing or empty"))
+			})
+		})
+
+		Context("when mixpanel can't be reached", func() {
+			It("should return the network error", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				server.Close()
+				err := m.ValidateToken(context.Background())
+				Expect(err).NotTo(BeNil())
+				Expect(err).NotTo(Equal(mixpanel.ErrInvalidToken))
+			})
+		})
+	})
+
+	Describe("TrackTimeSinceLastEvent", func() {
+		It("should add the seconds since the previous event for the same distinct ID", func() {
+			first := captureRequestData(server, "1")
+			other := captureRequestData(server, "1")
+			second := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TrackTimeSinceLastEvent = true
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "2"})).To(Succeed())
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(first["properties"]).NotTo(HaveKey("$time_since_last_event"))
+			Expect(other["properties"]).NotTo(HaveKey("$time_since_last_event"))
+			Expect(second["properties"]).To(HaveKeyWithValue("$time_since_last_event", BeNumerically(">=", 0)))
+		})
+
+		It("should forget distinct IDs that have been idle longer than LastEventTTL", func() {
+			captureRequestData(server, "1")
+			second := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TrackTimeSinceLastEvent = true
+			m.LastEventTTL = time.Millisecond
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			time.Sleep(5 * time.Millisecond)
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(second["properties"]).NotTo(HaveKey("$time_since_last_event"))
+		})
+
+		It("should forget the least recently active distinct IDs beyond LastEventCacheSize", func() {
+			captureRequestData(server, "1")
+			captureRequestData(server, "1")
+			third := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TrackTimeSinceLastEvent = true
+			m.LastEventCacheSize = 1
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "2"})).To(Succeed())
+			Expect(m.Track("Page Viewed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(third["properties"]).NotTo(HaveKey("$time_since_last_event"))
+		})
+	})
+
+	Describe("EventNameAliases", func() {
+		It("should send a copy of the event under each alias with its own $insert_id", func() {
+			events := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"User Signed Up", "Registered"}}
+			err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "$insert_id": "abc"})
+			Expect(err).To(BeNil())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			Expect(*events).To(HaveLen(3))
+
+			insertIDs := map[interface{}]bool{}
+			for i, name := range []string{"Signed Up", "User Signed Up", "Registered"} {
+				event := (*events)[i]
+				Expect(event["event"]).To(Equal(name))
+				properties := event["properties"].(map[string]interface{})
+				Expect(properties["$distinct_id"]).To(Equal("1"))
+				Expect(properties["token"]).To(Equal("token"))
+				insertIDs[properties["$insert_id"]] = true
+			}
+			Expect(insertIDs).To(HaveLen(3))
+			Expect(insertIDs).To(HaveKey("abc"))
+		})
+
+		It("should give the copies the same $insert_id every time the event is tracked", func() {
+			first := captureBatchData(server, "1")
+			second := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"Registered"}}
+			for i := 0; i < 2; i++ {
+				Expect(m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "$insert_id": "abc"})).To(Succeed())
+			}
+
+			insertID := (*first)[1]["properties"].(map[string]interface{})["$insert_id"]
+			Expect(insertID).To(HaveLen(32))
+			Expect(insertID).NotTo(Equal("abc"))
+			Expect((*second)[1]["properties"]).To(HaveKeyWithValue("$insert_id", insertID))
+		})
+
+		It("should skip the copies along with an event the IdempotencyStore already sent", func() {
+			captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"Registered"}}
+			m.IdempotencyStore = mixpanel.NewMemoryIdempotencyStore(10)
+			for i := 0; i < 2; i++ {
+				Expect(m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "$insert_id": "abc"})).To(Succeed())
+			}
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should still return errors that match ErrUnexpectedTrackResponse", func() {
+			captureBatchData(server, "0")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"Registered"}}
+			err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedTrackResponse)).To(BeTrue())
+		})
+
+		It("should send events without aliases on their own", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Logged In","properties":{"$distinct_id":"1","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"User Signed Up"}}
+			err := m.Track("Logged In", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(BeNil())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("OnDeadLetter", func() {
+		var deadLetters []mixpanel.Event
+		var deadLetterErrs []error
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			deadLetters = nil
+			deadLetterErrs = nil
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.OnDeadLetter = func(e mixpanel.Event, err error) {
+				deadLetters = append(deadLetters, e)
+				deadLetterErrs = append(deadLetterErrs, err)
+			}
+		})
+
+		It("should receive an event mixpanel rejected", func() {
+			captureRequestData(server, "0")
+			err := m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(deadLetters).To(HaveLen(1))
+			Expect(deadLetters[0].Name).To(Equal("User Signed Up"))
+			Expect(deadLetters[0].Properties["$distinct_id"]).To(Equal("1"))
+			Expect(deadLetterErrs[0]).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+		})
+
+		It("should not be called for delivered events", func() {
+			captureRequestData(server, "1")
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(deadLetters).To(BeEmpty())
+		})
+
+		It("should receive each event of a failed batch", func() {
+			captureBatchData(server, "1")
+			captureBatchData(server, "0")
+			pairs := make([]mixpanel.AliasPair, 52)
+			for i := range pairs {
+				pairs[i] = mixpanel.AliasPair{OldID: fmt.Sprintf("old-%d", i), NewID: fmt.Sprintf("new-%d", i)}
+			}
+			Expect(m.AliasBatch(pairs)).NotTo(Succeed())
+			Expect(deadLetters).To(HaveLen(2))
+			Expect(deadLetters[0].Properties["alias"]).To(Equal("new-50"))
+			Expect(deadLetters[1].Properties["alias"]).To(Equal("new-51"))
+		})
+	})
+
+	Describe("TrackWithGeo", func() {
+		Context("with a valid country code", func() {
+			BeforeEach(func() {
+				var verifier http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.URL.Path).To(Equal("/track/"))
+					Expect(r.URL.Query().Get("ip")).To(Equal("0"))
+					data := decodeBase64(r.PostFormValue("data"))
+					Expect(data).To(MatchJSON(`{"event":"Check In","properties":{"distinct_id":"1","$city":"London","$region":"England","$country_code":"GB","venue":"pub","token":"token"}}`))
+					fmt.Fprint(w, "1")
+				}
+				server.AppendHandlers(verifier)
+			})
+
+			It("should send the geo properties and disable IP geolocation", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				geo := mixpanel.Geo{City: "London", Region: "England", CountryCode: "gb"}
+				err := m.TrackWithGeo("1", "Check In", geo, map[string]interface{}{"venue": "pub"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+
+		Context("with an invalid country code", func() {
+			It("should return ErrInvalidCountryCode without sending anything", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				Expect(m.TrackWithGeo("1", "Check In", mixpanel.Geo{CountryCode: "XX"}, nil)).To(Equal(mixpanel.ErrInvalidCountryCode))
+				Expect(m.TrackWithGeo("1", "Check In", mixpanel.Geo{CountryCode: "GBR"}, nil)).To(Equal(mixpanel.ErrInvalidCountryCode))
+				Expect(server.ReceivedRequests()).Should(HaveLen(0))
+			})
+		})
+	})
+
+	Describe("GetProfile", func() {
+		Context("when the profile exists", func() {
+			var profile *mixpanel.Profile
+
+			BeforeEach(func() {
+				verifyQueryResponse(server,
+					"/2.0/engage/",
+					url.Values{"distinct_id": {"1"}},
+					http.StatusOK,
+					`{"page":0,"page_size":1000,"session_id":"abc","status":"ok","total":1,"results":[
+						{"$distinct_id":"1","$properties":{"$name":"Mclovin","age":"17","height":1.8,"$last_seen":"2014-03-01T12:30:00","signed_up":"2014-02-01T09:00:00Z","born":1000000000}}
+					]}`,
+				)
+
+				var err error
+				profile, err = newQueryClient().GetProfile(context.Background(), "1")
+				Expect(err).To(BeNil())
+			})
+
+			It("should return the profile", func() {
+				Expect(profile.DistinctID).To(Equal("1"))
+				Expect(profile.Properties).To(HaveKeyWithValue("$name", "Mclovin"))
+			})
+
+			It("should read string properties", func() {
+				name, ok := profile.GetString("$name")
+				Expect(ok).To(BeTrue())
+				Expect(name).To(Equal("Mclovin"))
+
+				_, ok = profile.GetString("height")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("should read number properties, including numbers stored as strings", func() {
+				height, ok := profile.GetFloat("height")
+				Expect(ok).To(BeTrue())
+				Expect(height).To(Equal(1.8))
+
+				age, ok := profile.GetFloat("age")
+				Expect(ok).To(BeTrue())
+				Expect(age).To(Equal(17.0))
+
+				_, ok = profile.GetFloat("$name")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("should read time properties in Mixpanel's encodings", func() {
+				lastSeen, ok := profile.GetTime("$last_seen")
+				Expect(ok).To(BeTrue())
+				Expect(lastSeen).To(Equal(time.Date(2014, 3, 1, 12, 30, 0, 0, time.UTC)))
+
+				signedUp, ok := profile.GetTime("signed_up")
+				Expect(ok).To(BeTrue())
+				Expect(signedUp).To(BeTemporally("==", time.Date(2014, 2, 1, 9, 0, 0, 0, time.UTC)))
+
+				born, ok := profile.GetTime("born")
+				Expect(ok).To(BeTrue())
+				Expect(born).To(Equal(time.Unix(1000000000, 0).UTC()))
+
+				_, ok = profile.GetTime("$name")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("should report missing properties", func() {
+				_, ok := profile.GetString("missing")
+				Expect(ok).To(BeFalse())
+			})
+		})
+
+		Context("when the profile does not exist", func() {
+			It("should return ErrProfileNotFound", func() {
+				verifyQueryResponse(server,
+					"/2.0/engage/",
+					url.Values{"distinct_id": {"2"}},
+					http.StatusOK,
+					`{"page":0,"page_size":1000,"session_id":"abc","status":"ok","total":0,"results":[]}`,
+				)
+
+				_, err := newQueryClient().GetProfile(context.Background(), "2")
+				Expect(err).To(Equal(mixpanel.ErrProfileNotFound))
+			})
+		})
+	})
+
+	Describe("Session", func() {
+		It("should attach the generated device ID to anonymous events", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Page Viewed","properties":{"$device_id":"device-1","distinct_id":"$device:device-1","page":"/pricing","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DeviceIDGenerator = func() string { return "device-1" }
+			s := m.NewSession()
+			Expect(s.DeviceID()).To(Equal("device-1"))
+			Expect(s.Track("Page Viewed", map[string]interface{}{"page": "/pricing"})).To(Succeed())
+		})
+
+		It("should attach both IDs once the user is identified", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"$device_id":"device-1","$user_id":"1","distinct_id":"1","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DeviceIDGenerator = func() string { return "device-1" }
+			s := m.NewSession()
+			s.Identify("1")
+			Expect(s.Track("Signed Up", nil)).To(Succeed())
+		})
+
+		It("should generate a random device ID by default", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.NewSession().DeviceID()).NotTo(BeEmpty())
+			Expect(m.NewSession().DeviceID()).NotTo(Equal(m.NewSession().DeviceID()))
+		})
+	})
+
+	Describe("TimeSource", func() {
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.TimeSource = func(properties map[string]interface{}) time.Time {
+				if createdAt, ok := properties["created_at"].(time.Time); ok {
+					return createdAt
+				}
+				return time.Time{}
+			}
+		})
+
+		It("should stamp events that have no time", func() {
+			data := captureRequestData(server, "1")
+			createdAt := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+			Expect(m.Track("Order Placed", map[string]interface{}{"$distinct_id": "1", "created_at": createdAt})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("time", BeNumerically("==", createdAt.Unix())))
+		})
+
+		It("should leave an explicit time alone", func() {
+			data := captureRequestData(server, "1")
+			createdAt := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+			Expect(m.Track("Order Placed", map[string]interface{}{"$distinct_id": "1", "created_at": createdAt, "time": 1000})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("time", BeNumerically("==", 1000)))
+		})
+
+		It("should leave the time unset when the source returns the zero time", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Order Placed", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).NotTo(HaveKey("time"))
+		})
+	})
+
+	Describe("Replay", func() {
+		var dst *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			dst = mixpanel.NewMixpanelClient("new_token", baseURL)
+			dst.APISecret = "secret"
+		})
+
+		It("should import exported events into the destination project", func() {
+			var imported []map[string]interface{}
+			var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/import/"))
+				user, _, ok := r.BasicAuth()
+				Expect(ok).To(BeTrue())
+				Expect(user).To(Equal("secret"))
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &imported)).To(Succeed())
+				fmt.Fprint(w, "1")
+			}
+			server.AppendHandlers(handler)
+
+			src := strings.NewReader(`{"event":"Signed Up","properties":{"distinct_id":"1","time":1393675200,"$insert_id":"abc","mp_processing_time_ms":1393675200123}}
+{"event":"Logged In","properties":{"distinct_id":"1","time":1393675300}}
+`)
+			result, err := mixpanel.Replay(context.Background(), src, dst)
+			Expect(err).To(BeNil())
+			Expect(result).To(Equal(mixpanel.BatchResult{Sent: 2}))
+			Expect(imported).To(HaveLen(2))
+			Expect(imported[0]).To(Equal(map[string]interface{}{
+				"event":      "Signed Up",
+				"properties": map[string]interface{}{"distinct_id": "1", "time": 1393675200.0, "$insert_id": "abc", "token": "new_token"},
+			}))
+			loggedIn := imported[1]["properties"].(map[string]interface{})
+			Expect(loggedIn["time"]).To(Equal(1393675300.0))
+			Expect(loggedIn["$insert_id"]).To(HaveLen(32))
+		})
+
+		It("should derive the same $insert_id every time an event is replayed", func() {
+			insertIDs := []interface{}{}
+			for i := 0; i < 2; i++ {
+				var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+					var imported []map[string]interface{}
+					Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &imported)).To(Succeed())
+					insertIDs = append(insertIDs, imported[0]["properties"].(map[string]interface{})["$insert_id"])
+					fmt.Fprint(w, "1")
+				}
+				server.AppendHandlers(handler)
+			}
+
+			line := `{"event":"Logged In","properties":{"distinct_id":"1","time":1393675300}}`
+			for i := 0; i < 2; i++ {
+				_, err := mixpanel.Replay(context.Background(), strings.NewReader(line), dst)
+				Expect(err).To(BeNil())
+			}
+			Expect(insertIDs[0]).To(Equal(insertIDs[1]))
+		})
+
+		It("should count lines that can't be imported as failed", func() {
+			captureBatchData(server, "1")
+			src := strings.NewReader(`not json
+{"event":"No Time","properties":{"distinct_id":"1"}}
+{"event":"Logged In","properties":{"distinct_id":"1","time":1393675300}}`)
+			result, err := mixpanel.Replay(context.Background(), src, dst)
+			Expect(err).To(HaveOccurred())
+			Expect(result).To(Equal(mixpanel.BatchResult{Sent: 1, Failed: 2}))
+		})
+
+		It("should count events in rejected batches as failed", func() {
+			captureBatchData(server, "0")
+			src := strings.NewReader(`{"event":"Logged In","properties":{"distinct_id":"1","time":1393675300}}`)
+			result, err := mixpanel.Replay(context.Background(), src, dst)
+			Expect(err).To(HaveOccurred())
+			Expect(result).To(Equal(mixpanel.BatchResult{Failed: 1}))
+		})
+
+		It("should send each batch as soon as it fills up", func() {
+			captureBatchData(server, "1")
+			var lines strings.Builder
+			for i := 0; i < 50; i++ {
+				fmt.Fprintf(&lines, `{"event":"Logged In","properties":{"distinct_id":"%d","time":1393675300}}`+"\n", i)
+			}
+			readErr := errors.New("connection reset")
+			src := io.MultiReader(strings.NewReader(lines.String()), iotest.ErrReader(readErr))
+
+			result, err := mixpanel.Replay(context.Background(), src, dst)
+			Expect(err).To(Equal(readErr))
+			Expect(result).To(Equal(mixpanel.BatchResult{Sent: 50}))
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should keep large integers exact", func() {
+			var body string
+			var handler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
+				body = decodeBase64(r.PostFormValue("data"))
+				fmt.Fprint(w, "1")
+			}
+			server.AppendHandlers(handler)
+
+			src := strings.NewReader(`{"event":"Order Placed","properties":{"distinct_id":"1","time":1393675300,"$insert_id":"abc","order_id":9007199254740993}}`)
+			_, err := mixpanel.Replay(context.Background(), src, dst)
+			Expect(err).To(BeNil())
+			Expect(body).To(ContainSubstring(`"order_id":9007199254740993`))
+		})
+	})
+
+	Describe("FileSink", func() {
+		var buffer *bytes.Buffer
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			buffer = &bytes.Buffer{}
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.Transport = mixpanel.NewFileSink(buffer)
+		})
+
+		It("should write each event as a line of JSON instead of sending it", func() {
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1", "time": 1000})).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(m.AliasBatch([]mixpanel.AliasPair{{OldID: "a", NewID: "1"}, {OldID: "b", NewID: "2"}})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+
+			lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+			Expect(lines).To(HaveLen(4))
+			Expect(lines[0]).To(MatchJSON(`{"event":"User Signed Up","properties":{"$distinct_id":"1","time":1000,"token":"token"}}`))
+			Expect(lines[1]).To(MatchJSON(`{"$token":"token","$distinct_id":"1","$set":{"plan":"pro"}}`))
+			Expect(lines[3]).To(ContainSubstring(`"alias":"2"`))
+		})
+
+		It("should stamp events with the time they were written", func() {
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			var event map[string]interface{}
+			Expect(json.Unmarshal(buffer.Bytes(), &event)).To(Succeed())
+			Expect(event["properties"]).To(HaveKeyWithValue("time", BeNumerically("~", time.Now().Unix(), 2)))
+		})
+
+		It("should produce files that Replay can import", func() {
+			Expect(m.Track("User Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(m.Track("Logged In", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+
+			imported := captureBatchData(server, "1")
+			dst := mixpanel.NewMixpanelClient("new_token", baseURL)
+			dst.APISecret = "secret"
+			result, err := mixpanel.Replay(context.Background(), buffer, dst)
+			Expect(err).To(BeNil())
+			Expect(result.Sent).To(Equal(2))
+			Expect(*imported).To(HaveLen(2))
+			Expect((*imported)[0]["properties"]).To(HaveKeyWithValue("token", "new_token"))
+		})
+	})
+
+	Describe("HTTPTransport", func() {
+		It("should send the payload to the endpoint on BaseURL", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"User Signed Up","properties":{"token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			response, err := mixpanel.HTTPTransport(m).Send(context.Background(), "/track/", nil,
+				map[string]interface{}{"event": "User Signed Up", "properties": map[string]interface{}{"token": "token"}})
+			Expect(err).To(BeNil())
+			Expect(response).To(Equal("1"))
+		})
+	})
+
+	Describe("DuplicateInsertIDs", func() {
+		exportLines := strings.Join([]string{
+			`{"event":"Logged In","properties":{"distinct_id":"1","time":1,"$insert_id":"a"}}`,
+			`{"event":"Logged In","properties":{"distinct_id":"1","time":1,"$insert_id":"a"}}`,
+			`{"event":"Logged In","properties":{"distinct_id":"2","time":1,"$insert_id":"b"}}`,
+		}, "\n")
+
+		var dst *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			dst = mixpanel.NewMixpanelClient("token", baseURL)
+			dst.APISecret = "secret"
+		})
+
+		It("should send duplicates by default", func() {
+			imported := captureBatchData(server, "1")
+			_, err := mixpanel.Replay(context.Background(), strings.NewReader(exportLines), dst)
+			Expect(err).To(BeNil())
+			Expect(*imported).To(HaveLen(3))
+		})
+
+		It("should reject batches with duplicates under RejectDuplicateInsertIDs", func() {
+			dst.DuplicateInsertIDs = mixpanel.RejectDuplicateInsertIDs
+			_, err := mixpanel.Replay(context.Background(), strings.NewReader(exportLines), dst)
+			Expect(err).To(Equal(mixpanel.ErrDuplicateInsertID))
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("should only send the first event with each $insert_id under DropDuplicateInsertIDs", func() {
+			imported := captureBatchData(server, "1")
+			dst.DuplicateInsertIDs = mixpanel.DropDuplicateInsertIDs
+			result, err := mixpanel.Replay(context.Background(), strings.NewReader(exportLines), dst)
+			Expect(err).To(BeNil())
+			Expect(result.Sent).To(Equal(2))
+			Expect(*imported).To(HaveLen(2))
+			Expect((*imported)[1]["properties"]).To(HaveKeyWithValue("$insert_id", "b"))
+		})
+
+		It("should treat insert IDs that aren't strings as missing", func() {
+			events := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DuplicateInsertIDs = mixpanel.RejectDuplicateInsertIDs
+			Expect(m.TrackBatch([]mixpanel.Event{
+				{Name: "Logged In", Properties: map[string]interface{}{"distinct_id": "1", "$insert_id": []interface{}{"a"}}},
+				{Name: "Logged In", Properties: map[string]interface{}{"distinct_id": "1", "$insert_id": []interface{}{"a"}}},
+			})).To(Succeed())
+			Expect(*events).To(HaveLen(2))
+		})
+
+		It("should apply to tracked batches as well", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DuplicateInsertIDs = mixpanel.RejectDuplicateInsertIDs
+			m.EventNameAliases = map[string][]string{"Signed Up": {"User Signed Up"}}
+			events := captureBatchData(server, "1")
+			Expect(m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "$insert_id": "a"})).To(Succeed())
+			Expect(*events).To(HaveLen(2))
+		})
+	})
+
+	Describe("CoerceStringers", func() {
+		It("should send the String() of Stringer values", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.CoerceStringers = true
+			createdAt := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+			err := m.Track("Status Changed", map[string]interface{}{"$distinct_id": "1", "status": status(1), "created_at": createdAt})
+			Expect(err).To(BeNil())
+			Expect(data["properties"]).To(HaveKeyWithValue("status", "active"))
+			Expect(data["properties"]).To(HaveKeyWithValue("created_at", "2014-03-01T12:00:00Z"))
+		})
+
+		It("should leave Stringer values alone when disabled", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.Track("Status Changed", map[string]interface{}{"$distinct_id": "1", "status": status(1)})
+			Expect(err).To(BeNil())
+			Expect(data["properties"]).To(HaveKeyWithValue("status", 1.0))
+		})
+	})
+
+	Describe("QueryInsights", func() {
+		Context("when mixpanel responds with a valid response", func() {
+			It("should return the report's series", func() {
+				verifyQueryResponse(server,
+					"/2.0/insights",
+					url.Values{"bookmark_id": {"12345"}, "project_id": {"42"}},
+					http.StatusOK,
+					`{"computed_at":"2020-09-21T16:35:41.252314+00:00","date_range":{"from_date":"2020-08-31T00:00:00-07:00","to_date":"2020-09-12T00:00:00-07:00"},
+					  "headers":["$event"],
+					  "series":{
+					    "Logged In":{"2020-08-31T00:00:00-07:00":10,"2020-09-07T00:00:00-07:00":12},
+					    "Purchase":{"$overall":{"2020-08-31T00:00:00-07:00":3},"US":{"2020-08-31T00:00:00-07:00":2}}
+					  }}`,
+				)
+				m := newQueryClient()
+				m.ProjectID = 42
+				result, err := m.QueryInsights(context.Background(), 12345)
+				Expect(err).To(BeNil())
+				Expect(result.ComputedAt).To(Equal("2020-09-21T16:35:41.252314+00:00"))
+				Expect(result.DateRange.From).To(Equal("2020-08-31T00:00:00-07:00"))
+				Expect(result.Headers).To(Equal([]string{"$event"}))
+				Expect(result.Series["Logged In"].Values).To(Equal(map[string]float64{
+					"2020-08-31T00:00:00-07:00": 10,
+					"2020-09-07T00:00:00-07:00": 12,
+				}))
+				Expect(result.Series["Purchase"].Values).To(BeEmpty())
+				Expect(result.Series["Purchase"].Breakdowns["US"].Values).To(Equal(map[string]float64{"2020-08-31T00:00:00-07:00": 2}))
+				Expect(result.Series["Purchase"].Breakdowns).To(HaveKey("$overall"))
+			})
+		})
+
+		Context("when mixpanel responds with an error", func() {
+			It("should return ErrUnexpectedQueryResponse", func() {
+				verifyQueryResponse(server,
+					"/2.0/insights",
+					url.Values{"bookmark_id": {"12345"}},
+					http.StatusBadRequest,
+					`{"error":"bookmark not found"}`,
+				)
+				_, err := newQueryClient().QueryInsights(context.Background(), 12345)
+				Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+			})
+		})
+	})
+
+	Describe("VerifyEventDelivered", func() {
+		since := time.Date(2020, 9, 1, 10, 30, 0, 0, time.UTC)
+
+		respondWithCounts := func(counts string) {
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/2.0/segmentation"))
+				Expect(r.URL.Query().Get("event")).To(Equal("Payment Completed"))
+				Expect(r.URL.Query().Get("unit")).To(Equal("hour"))
+				Expect(r.URL.Query().Get("from_date")).To(Equal("2020-09-01"))
+				fmt.Fprintf(w, `{"data":{"series":[],"values":{"Payment Completed":%s}},"legend_size":1}`, counts)
+			})
+		}
+
+		It("should poll until the event is counted from since's hour on", func() {
+			respondWithCounts(`{"2020-09-01 09:00:00":3}`)
+			respondWithCounts(`{"2020-09-01 09:00:00":3,"2020-09-01 10:00:00":1}`)
+
+			m := newQueryClient()
+			m.QueryCacheTTL = time.Minute
+			delivered, err := m.VerifyEventDelivered(context.Background(), "Payment Completed", since, time.Minute)
+			Expect(err).To(BeNil())
+			Expect(delivered).To(BeTrue())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should report false once the timeout runs out", func() {
+			respondWithCounts(`{"2020-09-01 09:00:00":3}`)
+
+			delivered, err := newQueryClient().VerifyEventDelivered(context.Background(), "Payment Completed", since, 0)
+			Expect(err).To(BeNil())
+			Expect(delivered).To(BeFalse())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should return ErrUnexpectedQueryResponse when mixpanel responds with an error", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, `{"error":"unknown event"}`))
+
+			_, err := newQueryClient().VerifyEventDelivered(context.Background(), "Payment Completed", since, time.Minute)
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+		})
+	})
+
+	Describe("empty distinct IDs", func() {
+		It("should be rejected by every profile operation", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.ProfileSet("", map[string]interface{}{"plan": "pro"})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileSetOnce("", map[string]interface{}{"plan": "pro"})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileAdd("", map[string]int{"logins": 1})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileAppend("", map[string]interface{}{"pages": "/"})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileUnion("", map[string]interface{}{"tags": []string{"a"}})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileUnset("", []string{"plan"})).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(m.ProfileDelete("")).To(Equal(mixpanel.ErrEmptyDistinctID))
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("should be sent with AllowEmptyDistinctID", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"","$set":{"plan":"pro"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.AllowEmptyDistinctID = true
+			Expect(m.ProfileSet("", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("TrackAndSet", func() {
+		trackResponse := func(response string) {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Plan Upgraded","properties":{"distinct_id":"1","from":"free","token":"token"}}`,
+				response,
+			)
+		}
+		setResponse := func(response string) {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"1","$set":{"plan":"pro"}}`,
+				response,
+			)
+		}
+		trackAndSet := func() error {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			return m.TrackAndSet("1", "Plan Upgraded", map[string]interface{}{"from": "free"}, map[string]interface{}{"plan": "pro"})
+		}
+
+		It("should track the event and set the profile properties", func() {
+			trackResponse("1")
+			setResponse("1")
+			Expect(trackAndSet()).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should still set the profile when tracking fails", func() {
+			trackResponse("0")
+			setResponse("1")
+			Expect(trackAndSet()).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should return the profile error when only setting fails", func() {
+			trackResponse("1")
+			setResponse("0")
+			Expect(trackAndSet()).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
+		})
+
+		It("should report both errors when both fail", func() {
+			trackResponse("0")
+			setResponse("0")
+			err := trackAndSet()
+			Expect(err.Error()).To(ContainSubstring(mixpanel.ErrUnexpectedTrackResponse.Error()))
+			Expect(err.Error()).To(ContainSubstring(mixpanel.ErrUnexpectedEngageResponse.Error()))
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedTrackResponse)).To(BeTrue())
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedEngageResponse)).To(BeTrue())
+		})
+	})
+
+	Describe("Schemas", func() {
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.Schemas = map[string]mixpanel.EventSchema{
+				"Signed Up": {Properties: []string{"plan"}},
+				"Purchase":  {Properties: []string{"amount"}, Unknown: mixpanel.RejectUnknown},
+			}
+		})
+
+		It("should drop unlisted properties under DropUnknown", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"$distinct_id":"1","time":1000,"plan":"pro","token":"token"}}`,
+				"1",
+			)
+			err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "time": 1000, "plan": "pro", "request_id": "abc"})
+			Expect(err).To(BeNil())
+		})
+
+		It("should reject unlisted properties under RejectUnknown", func() {
+			err := m.Track("Purchase", map[string]interface{}{"$distinct_id": "1", "amount": 10, "request_id": "abc"})
+			Expect(err).To(Equal(mixpanel.ErrUnknownProperty))
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("should send listed properties under RejectUnknown", func() {
+			captureRequestData(server, "1")
+			Expect(m.Track("Purchase", map[string]interface{}{"$distinct_id": "1", "amount": 10})).To(Succeed())
+		})
+
+		It("should leave events without a schema alone", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Logged In", map[string]interface{}{"$distinct_id": "1", "request_id": "abc"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKey("request_id"))
+		})
+	})
+
+	Describe("WithServerMetadata", func() {
+		It("should add the hostname, pid and build to every event", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithServerMetadata("4f2a9c1")
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			hostname, _ := os.Hostname()
+			Expect(data["properties"]).To(HaveKeyWithValue("$server_hostname", hostname))
+			Expect(data["properties"]).To(HaveKeyWithValue("$pid", BeNumerically("==", os.Getpid())))
+			Expect(data["properties"]).To(HaveKeyWithValue("$build", "4f2a9c1"))
+		})
+
+		It("should leave out an empty build and not override explicit properties", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithServerMetadata("")
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1", "$server_hostname": "web-1"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("$server_hostname", "web-1"))
+			Expect(data["properties"]).NotTo(HaveKey("$build"))
+		})
+
+		It("should not add anything when not enabled", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.Track("User Signed Up", map[string]interface{}{"$distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).NotTo(HaveKey("$pid"))
+		})
+	})
+
+	Describe("OrderedDelivery", func() {
+		var mu sync.Mutex
+		var received []float64
+		var inFlight, maxInFlight int
+
+		BeforeEach(func() {
+			received = nil
+			inFlight, maxInFlight = 0, 0
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				var data map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &data)).To(Succeed())
+
+				mu.Lock()
+				received = append(received, data["properties"].(map[string]interface{})["seq"].(float64))
+				inFlight++
+				if inFlight > maxInFlight {
+					maxInFlight = inFlight
+				}
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				inFlight--
+				mu.Unlock()
+				fmt.Fprint(w, "1")
+			})
+		})
+
+		trackConcurrently := func(m *mixpanel.Mixpanel, distinctIDs ...string) {
+			var wg sync.WaitGroup
+			for i, distinctID := range distinctIDs {
+				wg.Add(1)
+				go func(seq int, distinctID string) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					Expect(m.Track("State Changed", map[string]interface{}{"$distinct_id": distinctID, "seq": seq})).To(Succeed())
+				}(i, distinctID)
+				time.Sleep(5 * time.Millisecond)
+			}
+			wg.Wait()
+		}
+
+		It("should send the events of a distinct ID one at a time, in order", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.OrderedDelivery = true
+			trackConcurrently(m, "1", "1", "1", "1")
+			Expect(received).To(Equal([]float64{0, 1, 2, 3}))
+			Expect(maxInFlight).To(Equal(1))
+		})
+
+		It("should send the events of different distinct IDs concurrently", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.OrderedDelivery = true
+			trackConcurrently(m, "1", "2")
+			Expect(maxInFlight).To(Equal(2))
+		})
+	})
+
+	Describe("ProjectTimezone", func() {
+		It("should fetch the project's timezone once and cache it", func() {
+			verifyQueryResponse(server,
+				"/app/projects/42",
+				url.Values{},
+				http.StatusOK,
+				`{"status":"ok","results":{"id":42,"name":"Acme","timezone":"US/Pacific"}}`,
+			)
+			m := newQueryClient()
+			m.ProjectID = 42
+			location, err := m.ProjectTimezone(context.Background())
+			Expect(err).To(BeNil())
+			Expect(location.String()).To(Equal("US/Pacific"))
+
+			location, err = m.ProjectTimezone(context.Background())
+			Expect(err).To(BeNil())
+			Expect(location.String()).To(Equal("US/Pacific"))
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should require a ProjectID", func() {
+			_, err := newQueryClient().ProjectTimezone(context.Background())
+			Expect(err).To(Equal(mixpanel.ErrMissingProjectID))
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+		})
+
+		It("should not cache failures", func() {
+			verifyQueryResponse(server, "/app/projects/42", url.Values{}, http.StatusInternalServerError, `{"error":"oops"}`)
+			verifyQueryResponse(server, "/app/projects/42", url.Values{}, http.StatusOK, `{"status":"ok","results":{"timezone":"UTC"}}`)
+			m := newQueryClient()
+			m.ProjectID = 42
+			_, err := m.ProjectTimezone(context.Background())
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+			location, err := m.ProjectTimezone(context.Background())
+			Expect(err).To(BeNil())
+			Expect(location).To(Equal(time.UTC))
+		})
+	})
+
+	Describe("WithProfileCache", func() {
+		setResponse := func(properties string) {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"1","$set":`+properties+`}`,
+				"1",
+			)
+		}
+
+		It("should skip sets whose values were already set", func() {
+			setResponse(`{"plan":"pro","seats":5}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro", "seats": 5})).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro", "seats": 5})).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should send sets with changed values", func() {
+			setResponse(`{"plan":"pro"}`)
+			setResponse(`{"plan":"enterprise"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "enterprise"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should send the set again once the cache has expired", func() {
+			setResponse(`{"plan":"pro"}`)
+			setResponse(`{"plan":"pro"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.ProfileCacheTTL = time.Millisecond
+			m.WithProfileCache(100)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			time.Sleep(5 * time.Millisecond)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should expire each property from when it was set", func() {
+			setResponse(`{"plan":"pro"}`)
+			setResponse(`{"seats":5}`)
+			setResponse(`{"plan":"pro"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			m.ProfileCacheTTL = 50 * time.Millisecond
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			time.Sleep(30 * time.Millisecond)
+			// setting another property doesn't keep plan cached for longer
+			Expect(m.ProfileSet("1", map[string]interface{}{"seats": 5})).To(Succeed())
+			time.Sleep(30 * time.Millisecond)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"seats": 5})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("should read ProfileCacheTTL when it is used", func() {
+			setResponse(`{"plan":"pro"}`)
+			setResponse(`{"plan":"pro"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			m.ProfileCacheTTL = time.Millisecond
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			time.Sleep(5 * time.Millisecond)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should forget a profile after any other operation on it", func() {
+			setResponse(`{"plan":"pro"}`)
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"1","$delete":""}`,
+				"1",
+			)
+			setResponse(`{"plan":"pro"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(m.ProfileDelete("1")).To(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("should not cache failed sets", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"1","$set":{"plan":"pro"}}`,
+				"0",
+			)
+			setResponse(`{"plan":"pro"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL).WithProfileCache(100)
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).NotTo(Succeed())
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("TrackContext", func() {
+		It("should use the distinct ID stored in the context", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"User Signed Up","properties":{"distinct_id":"1","plan":"pro","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			ctx := mixpanel.ContextWithDistinctID(context.Background(), "1")
+			Expect(m.TrackContext(ctx, "User Signed Up", map[string]interface{}{"plan": "pro"})).To(Succeed())
+		})
+
+		It("should prefer an explicit distinct ID", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"User Signed Up","properties":{"$distinct_id":"2","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			ctx := mixpanel.ContextWithDistinctID(context.Background(), "1")
+			Expect(m.TrackContext(ctx, "User Signed Up", map[string]interface{}{"$distinct_id": "2"})).To(Succeed())
+		})
+
+		It("should abandon the request when the context is cancelled", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := m.TrackContext(ctx, "User Signed Up", map[string]interface{}{"$distinct_id": "1"})
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(server.ReceivedRequests()).Should(HaveLen(0))
+		})
+	})
+
+	Describe("DistinctIDFromContext", func() {
+		It("should report contexts without a distinct ID", func() {
+			_, ok := mixpanel.DistinctIDFromContext(context.Background())
+			Expect(ok).To(BeFalse())
+
+			distinctID, ok := mixpanel.DistinctIDFromContext(mixpanel.ContextWithDistinctID(context.Background(), "1"))
+			Expect(ok).To(BeTrue())
+			Expect(distinctID).To(Equal("1"))
+		})
+	})
+
+	Describe("Collector", func() {
+		var mu sync.Mutex
+		var received []map[string]interface{}
+		var requests int
+
+		BeforeEach(func() {
+			received = nil
+			requests = 0
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				var batch []map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &batch)).To(Succeed())
+				Expect(len(batch)).To(BeNumerically("<=", 50))
+
+				mu.Lock()
+				received = append(received, batch...)
+				requests++
+				mu.Unlock()
+				fmt.Fprint(w, "1")
+			})
+		})
+
+		It("should batch the events of many goroutines", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 4, FlushInterval: time.Hour})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						event := mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"$distinct_id": fmt.Sprint(i)}}
+						Expect(c.Submit(event)).To(Succeed())
+					}
+				}(i)
+			}
+			wg.Wait()
+			c.Close()
+
+			Expect(received).To(HaveLen(200))
+			Expect(requests).To(BeNumerically("<", 200))
+			Expect(received[0]["properties"]).To(HaveKeyWithValue("token", "token"))
+		})
+
+		It("should flush partial batches on the flush interval", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1, FlushInterval: 10 * time.Millisecond})
+			defer c.Close()
+
+			Expect(c.Submit(mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"$distinct_id": "1"}})).To(Succeed())
+			Eventually(func() int {
+				mu.Lock()
+				defer mu.Unlock()
+				return len(received)
+			}).Should(Equal(1))
+		})
+
+		It("should sample normal priority events under backpressure", func() {
+			release := make(chan struct{})
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				<-release
+				fmt.Fprint(w, "1")
+			})
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1, QueueSize: 2, FlushInterval: time.Millisecond, SampleAbove: 0.5})
+
+			// the first batch holds up the shard until released
+			Expect(c.Submit(mixpanel.Event{Name: "Page Viewed"})).To(Succeed())
+			Eventually(server.ReceivedRequests).Should(HaveLen(1))
+
+			high := mixpanel.Event{Name: "Purchase", Priority: mixpanel.PriorityHigh}
+			Expect(c.Submit(high)).To(Succeed())
+			Expect(c.Submit(high)).To(Succeed())
+			Expect(c.Submit(mixpanel.Event{Name: "Page Viewed"})).To(Equal(mixpanel.ErrEventSampledOut))
+
+			close(release)
+			c.Close()
+		})
+
+		It("should send alias copies and make the profile updates of the events", func() {
+			var engaged []map[string]interface{}
+			server.RouteToHandler("POST", "/engage/", func(w http.ResponseWriter, r *http.Request) {
+				var update map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &update)).To(Succeed())
+
+				mu.Lock()
+				engaged = append(engaged, update)
+				mu.Unlock()
+				fmt.Fprint(w, "1")
+			})
+
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventNameAliases = map[string][]string{"Signed Up": {"Registered"}}
+			m.EventTags = map[string][]string{"Signed Up": {"onboarded"}}
+			m.FirstTouchProperties = []string{"utm_source"}
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1, FlushInterval: time.Hour})
+			Expect(c.Submit(mixpanel.Event{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "1", "utm_source": "ads"}})).To(Succeed())
+			c.Close()
+
+			Expect(received).To(HaveLen(2))
+			Expect(received[0]["event"]).To(Equal("Signed Up"))
+			Expect(received[1]["event"]).To(Equal("Registered"))
+			Expect(engaged).To(ConsistOf(
+				HaveKeyWithValue("$union", map[string]interface{}{"tags": []interface{}{"onboarded"}}),
+				HaveKeyWithValue("$set_once", map[string]interface{}{"utm_source": "ads"}),
+			))
+		})
+
+		It("should make the profile updates of the events in the requests that succeeded", func() {
+			var mu sync.Mutex
+			tracks := 0
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if tracks++; tracks == 1 {
+					fmt.Fprint(w, "0")
+					return
+				}
+				fmt.Fprint(w, "1")
+			})
+			var engaged []interface{}
+			server.RouteToHandler("POST", "/engage/", func(w http.ResponseWriter, r *http.Request) {
+				var update map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &update)).To(Succeed())
+				mu.Lock()
+				engaged = append(engaged, update["$distinct_id"])
+				mu.Unlock()
+				fmt.Fprint(w, "1")
+			})
+
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventTags = map[string][]string{"Signed Up": {"onboarded"}}
+			// one request per event
+			m.MaxPayloadBytes = 1
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1, FlushInterval: time.Hour})
+			Expect(c.Submit(mixpanel.Event{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "1"}})).To(Succeed())
+			Expect(c.Submit(mixpanel.Event{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "2"}})).To(Succeed())
+			c.Close()
+
+			Expect(engaged).To(Equal([]interface{}{"2"}))
+		})
+
+		It("should reject events submitted after Close", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1})
+			c.Close()
+
+			Expect(c.Submit(mixpanel.Event{Name: "Page Viewed"})).To(Equal(mixpanel.ErrCollectorClosed))
+			c.Close()
+		})
+
+		It("should compact each batch before sending it", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			c := m.NewCollector(mixpanel.CollectorConfig{Shards: 1, FlushInterval: time.Hour, Compact: mixpanel.CompactByCount("count")})
+			for i := 0; i < 3; i++ {
+				Expect(c.Submit(mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"$distinct_id": "1"}})).To(Succeed())
+			}
+			Expect(c.Submit(mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"$distinct_id": "2"}})).To(Succeed())
+			Expect(c.Submit(mixpanel.Event{Name: "Signed Up", Properties: map[string]interface{}{"$distinct_id": "1"}})).To(Succeed())
+			c.Close()
+
+			Expect(requests).To(Equal(1))
+			Expect(received).To(HaveLen(3))
+			Expect(received[0]["event"]).To(Equal("Page Viewed"))
+			Expect(received[0]["properties"]).To(HaveKeyWithValue("count", 3.0))
+			Expect(received[1]["properties"]).To(HaveKeyWithValue("count", 1.0))
+			Expect(received[2]["event"]).To(Equal("Signed Up"))
+		})
+
+		It("should reject events their schema rejects", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Schemas = map[string]mixpanel.EventSchema{"Page Viewed": {Unknown: mixpanel.RejectUnknown}}
+			c := m.NewCollector(mixpanel.CollectorConfig{})
+			defer c.Close()
+
+			err := c.Submit(mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"page": "/"}})
+			Expect(err).To(Equal(mixpanel.ErrUnknownProperty))
+		})
+	})
+
+	Describe("FirstTouchProperties", func() {
+		Context("when the event carries a first-touch property", func() {
+			It("should also $set_once it on the profile", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Signed Up","properties":{"$distinct_id":"1","utm_source":"newsletter","plan":"pro","token":"token"}}`,
+					"1",
+				)
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/engage\/\z`,
+					`{"$token":"token","$distinct_id":"1","$set_once":{"utm_source":"newsletter"}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.FirstTouchProperties = []string{"utm_source", "utm_campaign"}
+				err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "utm_source": "newsletter", "plan": "pro"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+			})
+		})
+
+		Context("when the property is sent under a KeyCompressionMap key", func() {
+			It("should $set_once it under its full key", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Signed Up","properties":{"$distinct_id":"1","us":"newsletter","token":"token"}}`,
+					"1",
+				)
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/engage\/\z`,
+					`{"$token":"token","$distinct_id":"1","$set_once":{"utm_source":"newsletter"}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.FirstTouchProperties = []string{"utm_source"}
+				m.KeyCompressionMap = map[string]string{"utm_source": "us"}
+				err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "utm_source": "newsletter"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(2))
+			})
+		})
+
+		Context("when the event carries none of them", func() {
+			It("should only track the event", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Signed Up","properties":{"$distinct_id":"1","token":"token"}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.FirstTouchProperties = []string{"utm_source"}
+				err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+				Expect(err).To(BeNil())
+				Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+
+	Describe("RequestSigner", func() {
+		It("should sign the final request before it is sent", func() {
+			var signed string
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/track/"),
+				ghttp.VerifyHeaderKV("X-Signature", "/track/"),
+				func(w http.ResponseWriter, r *http.Request) {
+					body, err := io.ReadAll(r.Body)
+					Expect(err).To(BeNil())
+					Expect(string(body)).To(Equal(signed))
+				},
+				ghttp.RespondWith(200, "1"),
+			))
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.RequestSigner = func(req *http.Request) {
+				body, err := req.GetBody()
+				Expect(err).To(BeNil())
+				read, err := io.ReadAll(body)
+				Expect(err).To(BeNil())
+				signed = string(read)
+				req.Header.Set("X-Signature", req.URL.Path)
+			}
+			err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+			Expect(err).To(BeNil())
+			Expect(signed).To(HavePrefix("data="))
+		})
+
+		It("should sign query requests", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("X-Signature", "signed"),
+				ghttp.RespondWith(200, `{"status":"ok","total":3,"results":[]}`),
+			))
+			m := newQueryClient()
+			m.RequestSigner = func(req *http.Request) {
+				req.Header.Set("X-Signature", "signed")
+			}
+			_, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(BeNil())
+		})
+
+		It("should sign the warmup request", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("HEAD", "/"),
+				ghttp.VerifyHeaderKV("X-Signature", "signed"),
+				ghttp.RespondWith(200, ""),
+			))
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.RequestSigner = func(req *http.Request) {
+				req.Header.Set("X-Signature", "signed")
+			}
+			Expect(m.Warmup(context.Background())).To(Succeed())
+		})
+	})
+
+	Describe("NaN and infinite floats", func() {
+		Context("by default", func() {
+			It("should drop them with a warning and send the rest of the event", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Report Generated","properties":{"$distinct_id":"1","rows":10,"token":"token"}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				var warnings []string
+				m.OnWarning = func(warning string) {
+					warnings = append(warnings, warning)
+				}
+				err := m.Track("Report Generated", map[string]interface{}{
+					"$distinct_id": "1",
+					"rows":         10,
+					"ratio":        math.NaN(),
+					"rate":         float32(math.Inf(1)),
+				})
+				Expect(err).To(BeNil())
+				Expect(warnings).To(HaveLen(2))
+				Expect(warnings).To(ContainElement(ContainSubstring(`"ratio"`)))
+			})
+		})
+
+		Context("nested in lists and objects", func() {
+			It("should drop them from a copy", func() {
+				verifyRequestResponse(server,
+					"POST",
+					`\A\/track\/\z`,
+					`{"event":"Report Generated","properties":{"$distinct_id":"1","scores":[1,2],"samples":[0.5],"stats":{"rows":10,"ratios":[]},"token":"token"}}`,
+					"1",
+				)
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				var warnings []string
+				m.OnWarning = func(warning string) {
+					warnings = append(warnings, warning)
+				}
+				scores := []interface{}{1, math.NaN(), 2}
+				stats := map[string]interface{}{"rows": 10, "mean": math.Inf(1), "ratios": []interface{}{math.Inf(-1)}}
+				err := m.Track("Report Generated", map[string]interface{}{
+					"$distinct_id": "1",
+					"scores":       scores,
+					"samples":      []float64{0.5, math.NaN()},
+					"stats":        stats,
+				})
+				Expect(err).To(BeNil())
+				Expect(warnings).To(HaveLen(4))
+				Expect(warnings).To(ContainElement(ContainSubstring(`"stats.ratios[0]"`)))
+				Expect(scores).To(HaveLen(3))
+				Expect(stats).To(HaveKey("mean"))
+			})
+
+			It("should reject the event under StrictFloats", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.StrictFloats = true
+				err := m.Track("Report Generated", map[string]interface{}{"$distinct_id": "1", "stats": map[string]interface{}{"ratio": math.NaN()}})
+				Expect(err).To(Equal(mixpanel.ErrInvalidFloat))
+				Expect(server.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+
+		Context("with StrictFloats", func() {
+			It("should return ErrInvalidFloat without sending the event", func() {
+				m := mixpanel.NewMixpanelClient("token", baseURL)
+				m.StrictFloats = true
+				err := m.Track("Report Generated", map[string]interface{}{"$distinct_id": "1", "ratio": math.Inf(-1)})
+				Expect(err).To(Equal(mixpanel.ErrInvalidFloat))
+				Expect(server.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+	})
+
+	Describe("DistinctIDFromRequest", func() {
+		request := func(name, value string) *http.Request {
+			r, err := http.NewRequest("GET", "/", nil)
+			Expect(err).To(BeNil())
+			r.AddCookie(&http.Cookie{Name: name, Value: value})
+			return r
+		}
+
+		It("should read the distinct ID from the JavaScript library's cookie", func() {
+			m := mixpanel.NewMixpanelClient("token")
+			value := url.QueryEscape(`{"distinct_id":"$device:17f0a","$device_id":"17f0a","$initial_referrer":"$direct"}`)
+			distinctID, ok := m.DistinctIDFromRequest(request("mp_token_mixpanel", value))
+			Expect(ok).To(BeTrue())
+			Expect(distinctID).To(Equal("$device:17f0a"))
+		})
+
+		It("should read numeric distinct IDs", func() {
+			m := mixpanel.NewMixpanelClient("token")
+			distinctID, ok := m.DistinctIDFromRequest(request("mp_token_mixpanel", url.QueryEscape(`{"distinct_id":42}`)))
+			Expect(ok).To(BeTrue())
+			Expect(distinctID).To(Equal("42"))
+		})
+
+		It("should ignore the cookies of other projects", func() {
+			m := mixpanel.NewMixpanelClient("token")
+			_, ok := m.DistinctIDFromRequest(request("mp_other_mixpanel", url.QueryEscape(`{"distinct_id":"1"}`)))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should ignore malformed cookies", func() {
+			m := mixpanel.NewMixpanelClient("token")
+			_, ok := m.DistinctIDFromRequest(request("mp_token_mixpanel", "not-json"))
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("KeyCompressionMap", func() {
+		It("should send the properties under their short keys", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Searched","properties":{"distinct_id":"1","sq":"shoes","$browser":"Chrome","page":2,"token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.KeyCompressionMap = map[string]string{"search_query": "sq", "$browser": "br", "distinct_id": "d"}
+			err := m.Track("Searched", map[string]interface{}{"distinct_id": "1", "search_query": "shoes", "$browser": "Chrome", "page": 2})
+			Expect(err).To(BeNil())
+		})
+
+		It("should keep a property uncompressed when its short key is taken", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Searched","properties":{"distinct_id":"1","search_query":"shoes","sq":"other","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.KeyCompressionMap = map[string]string{"search_query": "sq"}
+			var warnings []string
+			m.OnWarning = func(warning string) {
+				warnings = append(warnings, warning)
+			}
+			err := m.Track("Searched", map[string]interface{}{"distinct_id": "1", "search_query": "shoes", "sq": "other"})
+			Expect(err).To(BeNil())
+			Expect(warnings).To(HaveLen(1))
+		})
+
+		It("should expand the short keys of properties read back", func() {
+			m := mixpanel.NewMixpanelClient("token")
+			m.KeyCompressionMap = map[string]string{"search_query": "sq"}
+			Expect(m.ExpandPropertyKeys(map[string]interface{}{"sq": "shoes", "page": 2})).To(Equal(map[string]interface{}{"search_query": "shoes", "page": 2}))
+		})
+	})
+
+	Describe("TrackChargeWithCurrency", func() {
+		transaction := func(data map[string]interface{}) map[string]interface{} {
+			Expect(data).To(HaveKeyWithValue("$distinct_id", "1"))
+			Expect(data).To(HaveKey("$append"))
+			appended := data["$append"].(map[string]interface{})
+			Expect(appended).To(HaveKey("$transactions"))
+			charge := appended["$transactions"].(map[string]interface{})
+			Expect(charge).To(HaveKey("$time"))
+			delete(charge, "$time")
+			return charge
+		}
+
+		It("should append the charge converted to BaseCurrency", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.BaseCurrency = "USD"
+			m.CurrencyConverter = func(amount float64, from, to string) (float64, error) {
+				Expect(from).To(Equal("EUR"))
+				Expect(to).To(Equal("USD"))
+				return amount * 2, nil
+			}
+			err := m.TrackChargeWithCurrency("1", 10, "eur", map[string]interface{}{"plan": "pro"})
+			Expect(err).To(BeNil())
+			Expect(transaction(data)).To(Equal(map[string]interface{}{
+				"$amount":         20.0,
+				"original_amount": 10.0,
+				"currency":        "EUR",
+				"plan":            "pro",
+			}))
+		})
+
+		It("should not convert charges in BaseCurrency", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.BaseCurrency = "USD"
+			err := m.TrackChargeWithCurrency("1", 10, "USD", nil)
+			Expect(err).To(BeNil())
+			Expect(transaction(data)).To(HaveKeyWithValue("$amount", 10.0))
+		})
+
+		It("should return ErrMissingCurrencyConverter for other currencies without a converter", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.BaseCurrency = "USD"
+			err := m.TrackChargeWithCurrency("1", 10, "EUR", nil)
+			Expect(err).To(Equal(mixpanel.ErrMissingCurrencyConverter))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("should return the converter's error", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.BaseCurrency = "USD"
+			m.CurrencyConverter = func(amount float64, from, to string) (float64, error) {
+				return 0, errors.New("no rate")
+			}
+			err := m.TrackChargeWithCurrency("1", 10, "EUR", nil)
+			Expect(err).To(MatchError("no rate"))
+		})
+	})
+
+	Describe("ExportProfilesCSV", func() {
+		It("should write every page of profiles as CSV", func() {
+			verifyQueryResponse(server,
+				"/2.0/engage/",
+				url.Values{"page": {"0"}, "where": {`properties["plan"] == "pro"`}},
+				http.StatusOK,
+				`{"page":0,"page_size":2,"session_id":"abc","status":"ok","total":3,"results":[
+					{"$distinct_id":"1","$properties":{"$email":"a@example.com","plan":"pro","seats":3,"tags":["beta","vip"]}},
+					{"$distinct_id":"2","$properties":{"plan":"pro","seats":1.5}}
+				]}`,
+			)
+			verifyQueryResponse(server,
+				"/2.0/engage/",
+				url.Values{"page": {"1"}, "session_id": {"abc"}, "where": {`properties["plan"] == "pro"`}},
+				http.StatusOK,
+				`{"page":1,"page_size":2,"session_id":"abc","status":"ok","total":3,"results":[
+					{"$distinct_id":"3","$properties":{"$email":"c@example.com, inc"}}
+				]}`,
+			)
+			m := newQueryClient()
+			var out bytes.Buffer
+			err := m.ExportProfilesCSV(context.Background(), `properties["plan"] == "pro"`, []string{"$distinct_id", "$email", "seats", "tags"}, &out)
+			Expect(err).To(BeNil())
+			Expect(out.String()).To(Equal(`$distinct_id,$email,seats,tags
+1,a@example.com,3,"[""beta"",""vip""]"
+2,,1.5,
+3,"c@example.com, inc",,
+`))
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should return ErrUnexpectedQueryResponse when a page fails", func() {
+			verifyQueryResponse(server,
+				"/2.0/engage/",
+				url.Values{"page": {"0"}},
+				http.StatusInternalServerError,
+				`{"error":"boom"}`,
+			)
+			m := newQueryClient()
+			var out bytes.Buffer
+			err := m.ExportProfilesCSV(context.Background(), "", []string{"$distinct_id"}, &out)
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+		})
+	})
+
+	Describe("TrackCritical", func() {
+		It("should retry until the event is delivered", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			delivered := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.TrackCritical(context.Background(), "Payment Completed", map[string]interface{}{"distinct_id": "1"})
+			Expect(err).To(BeNil())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+			Expect(*delivered).To(HaveLen(1))
+			Expect((*delivered)[0]["properties"]).To(HaveKey("$insert_id"))
+		})
+
+		It("should give up after 3 attempts and dead letter the event", func() {
+			for i := 0; i < 3; i++ {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			}
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			var dead []mixpanel.Event
+			m.OnDeadLetter = func(e mixpanel.Event, err error) {
+				dead = append(dead, e)
+			}
+			err := m.TrackCritical(context.Background(), "Payment Completed", map[string]interface{}{"distinct_id": "1"})
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+			Expect(dead).To(HaveLen(1))
+		})
+
+		It("should follow Retry rather than retry on top of it", func() {
+			for i := 0; i < 4; i++ {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			}
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Retry = mixpanel.RetryConfig{MaxAttempts: 4, BaseDelay: time.Millisecond}
+			err := m.TrackCritical(context.Background(), "Payment Completed", map[string]interface{}{"distinct_id": "1"})
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(4))
+		})
+
+		It("should not retry events Mixpanel rejects", func() {
+			captureBatchData(server, "0")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.TrackCritical(context.Background(), "Payment Completed", map[string]interface{}{"distinct_id": "1"})
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should retry when Mixpanel can't be reached", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			attempts := 0
+			m.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				attempts++
+				return nil, errors.New("connection refused")
+			})}
+			err := m.TrackCritical(context.Background(), "Payment Completed", map[string]interface{}{"distinct_id": "1"})
+			Expect(err).To(HaveOccurred())
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("should bypass OrderedDelivery", func() {
+			captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.OrderedDelivery = true
+			err := m.TrackCritical(mixpanel.ContextWithDistinctID(context.Background(), "1"), "Payment Completed", nil)
+			Expect(err).To(BeNil())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("SchemaVersion", func() {
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.SchemaVersion = "2"
+			m.SchemaVersions = map[string]string{"Checkout Completed": "3"}
+		})
+
+		It("should add the schema version to every event", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("schema_version", "2"))
+		})
+
+		It("should use the event's own version from SchemaVersions", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Checkout Completed", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("schema_version", "3"))
+		})
+
+		It("should keep the version set by the call", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Checkout Completed", map[string]interface{}{"distinct_id": "1", "schema_version": "4"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("schema_version", "4"))
+		})
+
+		It("should keep the version set by the call when the event has a schema", func() {
+			m.Schemas = map[string]mixpanel.EventSchema{"Checkout Completed": {Unknown: mixpanel.RejectUnknown}}
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Checkout Completed", map[string]interface{}{"distinct_id": "1", "schema_version": "4"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("schema_version", "4"))
+		})
+	})
+
+	Describe("Deprecation notices", func() {
+		It("should pass each distinct notice to OnWarning once", func() {
+			header := http.Header{}
+			header.Add("Warning", `299 - "this endpoint is deprecated"`)
+			header.Add("Sunset", "Wed, 01 Jan 2031 00:00:00 GMT")
+			for i := 0; i < 2; i++ {
+				server.AppendHandlers(ghttp.RespondWith(200, "1", header))
+			}
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			var warnings []string
+			m.OnWarning = func(warning string) {
+				warnings = append(warnings, warning)
+			}
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(warnings).To(ConsistOf(
+				`Mixpanel Warning header for /track/: 299 - "this endpoint is deprecated"`,
+				"Mixpanel Sunset header for /track/: Wed, 01 Jan 2031 00:00:00 GMT",
+			))
+		})
+
+		It("should surface the notices of the query APIs", func() {
+			server.AppendHandlers(ghttp.RespondWith(200, `{"status":"ok","total":1,"results":[]}`, http.Header{"Deprecation": {"true"}}))
+			m := newQueryClient()
+			var warnings []string
+			m.OnWarning = func(warning string) {
+				warnings = append(warnings, warning)
+			}
+			_, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(BeNil())
+			Expect(warnings).To(Equal([]string{"Mixpanel Deprecation header for /2.0/engage/: true"}))
+		})
+	})
+
+	Describe("Batch", func() {
+		It("should send nothing until flushed", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("should send the tracked events together on Flush", func() {
+			batch := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(b.Track("Result Clicked", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(b.Flush(context.Background())).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			Expect(*batch).To(HaveLen(2))
+			Expect((*batch)[1]["event"]).To(Equal("Result Clicked"))
+
+			Expect(b.Flush(context.Background())).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should return schema errors from Track", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Schemas = map[string]mixpanel.EventSchema{"Search": {Unknown: mixpanel.RejectUnknown}}
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"query": "shoes"})).To(Equal(mixpanel.ErrUnknownProperty))
+		})
+
+		It("should report the failed requests", func() {
+			captureBatchData(server, "0")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			err := b.Flush(context.Background())
+			var batchErr *mixpanel.BatchError
+			Expect(errors.As(err, &batchErr)).To(BeTrue())
+		})
+
+		It("should make the profile updates of the events in the requests that succeeded", func() {
+			var mu sync.Mutex
+			tracks := 0
+			server.RouteToHandler("POST", "/track/", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				if tracks++; tracks == 1 {
+					fmt.Fprint(w, "0")
+					return
+				}
+				fmt.Fprint(w, "1")
+			})
+			var engaged []interface{}
+			server.RouteToHandler("POST", "/engage/", func(w http.ResponseWriter, r *http.Request) {
+				var update map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &update)).To(Succeed())
+				mu.Lock()
+				engaged = append(engaged, update["$distinct_id"])
+				mu.Unlock()
+				fmt.Fprint(w, "1")
+			})
+
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventTags = map[string][]string{"Search": {"searcher"}}
+			// one request per event
+			m.MaxPayloadBytes = 1
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "2"})).To(Succeed())
+
+			var batchErr *mixpanel.BatchError
+			Expect(errors.As(b.Flush(context.Background()), &batchErr)).To(BeTrue())
+			Expect(batchErr.Errors()).To(HaveLen(1))
+			Expect(batchErr.ProfileErrors()).To(BeEmpty())
+			Expect(engaged).To(Equal([]interface{}{"2"}))
+		})
+
+		It("should report the profile updates that failed", func() {
+			server.RouteToHandler("POST", "/track/", ghttp.RespondWith(http.StatusOK, "1"))
+			server.RouteToHandler("POST", "/engage/", ghttp.RespondWith(http.StatusOK, "0"))
+
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.EventTags = map[string][]string{"Search": {"searcher"}}
+			b := m.NewBatch()
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(b.Track("Search", map[string]interface{}{"distinct_id": "2"})).To(Succeed())
+
+			var batchErr *mixpanel.BatchError
+			Expect(errors.As(b.Flush(context.Background()), &batchErr)).To(BeTrue())
+			Expect(batchErr.Errors()).To(BeEmpty())
+			Expect(batchErr.ProfileErrors()).To(HaveLen(2))
+			Expect(errors.Is(batchErr, mixpanel.ErrUnexpectedEngageResponse)).To(BeTrue())
+		})
+	})
+
+	Describe("DistinctIDField", func() {
+		It("should send the custom field as distinct_id", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"distinct_id":"42","plan":"pro","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DistinctIDField = "user_id"
+			err := m.Track("Signed Up", map[string]interface{}{"user_id": 42, "$distinct_id": "stale", "plan": "pro"})
+			Expect(err).To(BeNil())
+		})
+
+		It("should leave a field that isn't a string or an integer as it is", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"$distinct_id":"1","user_id":null,"token":"token"}}`,
+				"1",
+			)
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"$distinct_id":"1","user_id":"42","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DistinctIDField = "user_id"
+			Expect(m.Track("Signed Up", map[string]interface{}{"user_id": nil, "$distinct_id": "1"})).To(Succeed())
+			id := "42"
+			Expect(m.Track("Signed Up", map[string]interface{}{"user_id": &id, "$distinct_id": "1"})).To(Succeed())
+		})
+
+		It("should let the distinct ID in the context fill in when the field is missing", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"distinct_id":"1","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.DistinctIDField = "user_id"
+			err := m.TrackContext(mixpanel.ContextWithDistinctID(context.Background(), "1"), "Signed Up", map[string]interface{}{})
+			Expect(err).To(BeNil())
+		})
+
+		It("should send the reserved names as they are by default", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"$distinct_id":"1","user_id":"42","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1", "user_id": "42"})
+			Expect(err).To(BeNil())
+		})
+	})
+
+	Describe("CaptureCaller", func() {
+		It("should send the function that tracked the event", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.CaptureCaller = true
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("$source_function", MatchRegexp(`^github\.com/nitrous-io/go-mixpanel_test\.`)))
+		})
+
+		It("should find the caller of events delivered in order", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.CaptureCaller = true
+			m.OrderedDelivery = true
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("$source_function", MatchRegexp(`^github\.com/nitrous-io/go-mixpanel_test\.`)))
+		})
+
+		It("should be off by default", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).NotTo(HaveKey("$source_function"))
+		})
+	})
+
+	Describe("ProfileUnion of large lists", func() {
+		It("should split the lists across requests within MaxPayloadBytes", func() {
+			var mu sync.Mutex
+			union := map[string][]interface{}{}
+			others := []map[string]interface{}{}
+			server.RouteToHandler("POST", "/engage/", func(w http.ResponseWriter, r *http.Request) {
+				Expect(len(r.PostFormValue("data"))).To(BeNumerically("<=", 4096))
+				var data map[string]interface{}
+				Expect(json.Unmarshal([]byte(decodeBase64(r.PostFormValue("data"))), &data)).To(Succeed())
+				Expect(data).To(HaveKeyWithValue("$distinct_id", "1"))
+
+				mu.Lock()
+				defer mu.Unlock()
+				for key, value := range data["$union"].(map[string]interface{}) {
+					if list, ok := value.([]interface{}); ok {
+						union[key] = append(union[key], list...)
+					} else {
+						others = append(others, map[string]interface{}{key: value})
+					}
+				}
+				fmt.Fprint(w, "1")
+			})
+
+			items := make([]string, 1000)
+			for i := range items {
+				items[i] = fmt.Sprintf("item-%04d", i)
+			}
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxPayloadBytes = 4096
+			err := m.ProfileUnion("1", map[string]interface{}{"items": items, "tags": []string{"a", "b"}, "plan": "pro"})
+			Expect(err).To(BeNil())
+			Expect(len(server.ReceivedRequests())).To(BeNumerically(">", 1))
+			Expect(union["items"]).To(HaveLen(1000))
+			Expect(union["items"][999]).To(Equal("item-0999"))
+			Expect(union["tags"]).To(Equal([]interface{}{"a", "b"}))
+			Expect(others).To(Equal([]map[string]interface{}{{"plan": "pro"}}))
+		})
+
+		It("should stop at the first request that fails", func() {
+			server.RouteToHandler("POST", "/engage/", ghttp.RespondWith(200, "0"))
+			items := make([]string, 1000)
+			for i := range items {
+				items[i] = fmt.Sprintf("item-%04d", i)
+			}
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxPayloadBytes = 4096
+			err := m.ProfileUnion("1", map[string]interface{}{"items": items})
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
+			Expect(server.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Describe("Client", func() {
+		It("should send the requests through the configured client", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/engage\/\z`,
+				`{"$token":"token","$distinct_id":"1","$set":{"plan":"pro"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			var sent int
+			m.Client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				sent++
+				return http.DefaultTransport.RoundTrip(r)
+			})}
+			Expect(m.ProfileSet("1", map[string]interface{}{"plan": "pro"})).To(Succeed())
+			Expect(sent).To(Equal(1))
+		})
+
+		It("should give up on requests that outlive the client's timeout", func() {
+			release := make(chan struct{})
+			defer close(release)
+			server.AppendHandlers(func(w http.ResponseWriter, r *http.Request) {
+				<-release
+			})
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Client = &http.Client{Timeout: 10 * time.Millisecond}
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).NotTo(Succeed())
+		})
+
+		It("should abandon profile updates when the context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.ProfileSetContext(ctx, "1", map[string]interface{}{"plan": "pro"})
+			Expect(errors.Is(err, context.Canceled)).To(BeTrue())
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Describe("time.Time properties", func() {
+		It("should send the event time as Unix seconds whatever its location", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			t := time.Date(2021, 3, 4, 5, 6, 7, 0, time.FixedZone("UTC+2", 2*60*60))
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1", "time": t})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("time", float64(t.Unix())))
+		})
+
+		It("should drop zero times with a warning", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Signed Up","properties":{"distinct_id":"1","token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			var warnings []string
+			m.OnWarning = func(warning string) {
+				warnings = append(warnings, warning)
+			}
+			var zero time.Time
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1", "time": zero, "trial_ends": &zero})).To(Succeed())
+			Expect(warnings).To(HaveLen(2))
+		})
+
+		It("should let TimeSource fill in a dropped zero time", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.TimeSource = func(map[string]interface{}) time.Time { return time.Unix(1600000000, 0) }
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1", "time": time.Time{}})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("time", 1600000000.0))
+		})
+	})
+
+	Describe("QueryCacheTTL", func() {
+		countResponse := func(total int) {
+			verifyQueryResponse(server,
+				"/2.0/engage/",
+				url.Values{"page": {"0"}},
+				http.StatusOK,
+				fmt.Sprintf(`{"status":"ok","total":%d,"results":[]}`, total),
+			)
+		}
+
+		It("should answer identical queries from the cache within the TTL", func() {
+			countResponse(1)
+			m := newQueryClient()
+			m.QueryCacheTTL = time.Minute
+			for i := 0; i < 2; i++ {
+				count, err := m.ProfileCount(context.Background(), "")
+				Expect(err).To(BeNil())
+				Expect(count).To(Equal(1))
+			}
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should query Mixpanel again once the TTL has passed", func() {
+			countResponse(1)
+			countResponse(2)
+			m := newQueryClient()
+			m.QueryCacheTTL = 10 * time.Millisecond
+			_, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(BeNil())
+			time.Sleep(20 * time.Millisecond)
+			count, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(2))
+		})
+
+		It("should not cache failed queries", func() {
+			verifyQueryResponse(server, "/2.0/engage/", url.Values{"page": {"0"}}, http.StatusInternalServerError, "")
+			countResponse(3)
+			m := newQueryClient()
+			m.QueryCacheTTL = time.Minute
+			_, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(Equal(mixpanel.ErrUnexpectedQueryResponse))
+			count, err := m.ProfileCount(context.Background(), "")
+			Expect(err).To(BeNil())
+			Expect(count).To(Equal(3))
+		})
+
+		It("should query Mixpanel every time by default", func() {
+			countResponse(1)
+			countResponse(1)
+			m := newQueryClient()
+			for i := 0; i < 2; i++ {
+				_, err := m.ProfileCount(context.Background(), "")
+				Expect(err).To(BeNil())
+			}
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+	})
+
+	Describe("TrackBatch", func() {
+		events := func(n int) []mixpanel.Event {
+			events := make([]mixpanel.Event, n)
+			for i := range events {
+				events[i] = mixpanel.Event{Name: "Page Viewed", Properties: map[string]interface{}{"distinct_id": fmt.Sprint(i)}}
+			}
+			return events
+		}
+
+		It("should send the events 50 per request with the token", func() {
+			first := captureBatchData(server, "1")
+			second := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.TrackBatch(events(50))).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			Expect(*first).To(HaveLen(50))
+			Expect((*first)[49]["properties"]).To(HaveKeyWithValue("token", "token"))
+
+			Expect(m.TrackBatch(events(1))).To(Succeed())
+			Expect(*second).To(HaveLen(1))
+		})
+
+		It("should use the distinct ID stored in the context for events without one", func() {
+			batch := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			ctx := mixpanel.ContextWithDistinctID(context.Background(), "1")
+			Expect(m.TrackBatchContext(ctx, []mixpanel.Event{
+				{Name: "Page Viewed"},
+				{Name: "Page Viewed", Properties: map[string]interface{}{"distinct_id": "2"}},
+			})).To(Succeed())
+			Expect((*batch)[0]["properties"]).To(HaveKeyWithValue("distinct_id", "1"))
+			Expect((*batch)[1]["properties"]).To(HaveKeyWithValue("distinct_id", "2"))
+		})
+
+		It("should identify the request that failed", func() {
+			captureBatchData(server, "1")
+			captureBatchData(server, "0")
+			captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			err := m.TrackBatch(events(120))
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+			var batchErr *mixpanel.BatchError
+			Expect(errors.As(err, &batchErr)).To(BeTrue())
+			Expect(batchErr.Errors()).To(HaveLen(1))
+			Expect(batchErr.Errors()[0].Index).To(Equal(1))
+			Expect(batchErr.Errors()[0].Events[0].Properties).To(HaveKeyWithValue("distinct_id", "50"))
+		})
+
+		It("should send nothing when an event is rejected", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Schemas = map[string]mixpanel.EventSchema{"Page Viewed": {Properties: []string{"page"}, Unknown: mixpanel.RejectUnknown}}
+			err := m.TrackBatch([]mixpanel.Event{{Name: "Page Viewed", Properties: map[string]interface{}{"referrer": "x"}}})
+			Expect(err).To(Equal(mixpanel.ErrUnknownProperty))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Describe("MaxProperties", func() {
+		properties := func() map[string]interface{} {
+			return map[string]interface{}{"distinct_id": "1", "$browser": "Chrome", "c": 3, "a": 1, "b": 2}
+		}
+
+		It("should reject events over the cap", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 5
+			Expect(m.Track("Page Viewed", properties())).To(Equal(mixpanel.ErrTooManyProperties))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("should send events within the cap as they are", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 6
+			Expect(m.Track("Page Viewed", properties())).To(Succeed())
+			Expect(data["properties"]).To(HaveLen(6))
+		})
+
+		It("should keep the reserved properties and then the first keys when pruning", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Page Viewed","properties":{"distinct_id":"1","$browser":"Chrome","a":1,"_properties_pruned":true,"token":"token"}}`,
+				"1",
+			)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 5
+			m.PruneProperties = true
+			Expect(m.Track("Page Viewed", properties())).To(Succeed())
+		})
+
+		It("should count the $insert_id given to alias copies", func() {
+			batch := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 5
+			m.PruneProperties = true
+			m.EventNameAliases = map[string][]string{"Page Viewed": {"Screen Viewed"}}
+			Expect(m.Track("Page Viewed", properties())).To(Succeed())
+			Expect(*batch).To(HaveLen(2))
+			Expect((*batch)[0]["properties"]).To(HaveLen(4))
+			Expect((*batch)[1]["properties"]).To(HaveLen(5))
+			Expect((*batch)[1]["properties"]).To(HaveKey("distinct_id"))
+		})
+
+		It("should count the $insert_id of critical events", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 6
+			Expect(m.TrackCritical(context.Background(), "Page Viewed", properties())).To(Equal(mixpanel.ErrTooManyProperties))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+
+		It("should reject caps too small for the reserved properties", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.MaxProperties = 2
+			m.PruneProperties = true
+			Expect(m.Track("Page Viewed", properties())).To(Equal(mixpanel.ErrTooManyProperties))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Describe("Verbose", func() {
+		respond := func(path, body string) {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", path, "verbose=1"),
+				ghttp.RespondWith(200, body),
+			))
+		}
+
+		It("should return Mixpanel's reason for rejecting an event", func() {
+			respond("/track/", `{"status":0,"error":"data, missing or empty"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Verbose = true
+			err := m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})
+			var verboseErr *mixpanel.VerboseError
+			Expect(errors.As(err, &verboseErr)).To(BeTrue())
+			Expect(verboseErr.Message).To(Equal("data, missing or empty"))
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedTrackResponse)).To(BeTrue())
+		})
+
+		It("should return Mixpanel's reason for rejecting a profile update", func() {
+			respond("/engage/", `{"status":0,"error":"$distinct_id, missing or empty"}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Verbose = true
+			err := m.ProfileSet("1", map[string]interface{}{"plan": "pro"})
+			Expect(err).To(MatchError(`Unexpected Mixpanel Engage Response: $distinct_id, missing or empty`))
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedEngageResponse)).To(BeTrue())
+		})
+
+		It("should succeed on a verbose success", func() {
+			respond("/track/", `{"status":1,"error":null}`)
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.Verbose = true
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+		})
+
+		It("should keep the sentinel errors without Verbose", func() {
+			verifyRequestResponse(server, "POST", `\A\/track\/\z`, `{"event":"Signed Up","properties":{"distinct_id":"1","token":"token"}}`, "0")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+		})
+	})
+
+	Describe("IdempotencyStore", func() {
+		It("should skip the events it already sent", func() {
+			data := captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.IdempotencyStore = mixpanel.NewMemoryIdempotencyStore(10)
+			for i := 0; i < 2; i++ {
+				Expect(m.Track("Order Placed", map[string]interface{}{"distinct_id": "1", "$insert_id": "order-1"})).To(Succeed())
+			}
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+			Expect(data["properties"]).To(HaveKeyWithValue("$insert_id", "order-1"))
+		})
+
+		It("should send events again when sending them failed", func() {
+			captureRequestData(server, "0")
+			captureRequestData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.IdempotencyStore = mixpanel.NewMemoryIdempotencyStore(10)
+			properties := map[string]interface{}{"distinct_id": "1", "$insert_id": "order-1"}
+			Expect(m.Track("Order Placed", properties)).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(m.Track("Order Placed", properties)).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should leave sent events out of batches", func() {
+			batch := captureBatchData(server, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			store := mixpanel.NewMemoryIdempotencyStore(10)
+			Expect(store.Add(context.Background(), "order-1")).To(Succeed())
+			m.IdempotencyStore = store
+			err := m.TrackBatch([]mixpanel.Event{
+				{Name: "Order Placed", Properties: map[string]interface{}{"distinct_id": "1", "$insert_id": "order-1"}},
+				{Name: "Order Placed", Properties: map[string]interface{}{"distinct_id": "1", "$insert_id": "order-2"}},
+			})
+			Expect(err).To(BeNil())
+			Expect(*batch).To(HaveLen(1))
+			sent, err := store.Has(context.Background(), "order-2")
+			Expect(err).To(BeNil())
+			Expect(sent).To(BeTrue())
+		})
+
+		It("should return the store's errors without sending", func() {
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			m.IdempotencyStore = failingStore{}
+			err := m.Track("Order Placed", map[string]interface{}{"distinct_id": "1", "$insert_id": "order-1"})
+			Expect(err).To(MatchError("store unavailable"))
+			Expect(server.ReceivedRequests()).Should(BeEmpty())
+		})
+	})
+
+	Describe("Retry", func() {
+		var m *mixpanel.Mixpanel
+
+		BeforeEach(func() {
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.Retry = mixpanel.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+		})
+
+		It("should retry 429 and 5xx responses until one succeeds", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusServiceUnavailable, ""),
+				ghttp.RespondWith(http.StatusTooManyRequests, "", http.Header{"Retry-After": {"3600"}}),
+				ghttp.RespondWith(http.StatusOK, "1"),
+			)
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1", "$insert_id": "abc"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("should handle the last response as usual once the attempts run out", func() {
+			for i := 0; i < 3; i++ {
+				server.AppendHandlers(ghttp.RespondWith(http.StatusBadGateway, ""))
+			}
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1", "$insert_id": "abc"})).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(3))
+		})
+
+		It("should not retry other client errors", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, "0"))
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should only retry additive profile updates when rate limited", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusTooManyRequests, ""),
+				ghttp.RespondWith(http.StatusServiceUnavailable, ""),
+			)
+			Expect(m.ProfileAdd("1", map[string]int{"logins": 1})).To(Equal(mixpanel.ErrUnexpectedEngageResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should only retry events without an $insert_id when rate limited", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusTooManyRequests, ""),
+				ghttp.RespondWith(http.StatusServiceUnavailable, ""),
+			)
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should only retry batches after a 5xx when every event has an $insert_id", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			err := m.TrackBatch([]mixpanel.Event{
+				{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "1", "$insert_id": "abc"}},
+				{Name: "Signed Up", Properties: map[string]interface{}{"distinct_id": "2"}},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should stop waiting when the context is done", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			m.Retry.BaseDelay = time.Hour
+			m.Retry.MaxDelay = time.Hour
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			err := m.TrackContext(ctx, "Signed Up", map[string]interface{}{"distinct_id": "1", "$insert_id": "abc"})
+			Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should retry the verbose errors listed as retryable", func() {
+			server.AppendHandlers(
+				ghttp.RespondWith(http.StatusOK, `{"status":0,"error":"service temporarily unavailable"}`),
+				ghttp.RespondWith(http.StatusOK, `{"status":1,"error":null}`),
+			)
+			m.Verbose = true
+			m.Retry.RetryableErrors = []string{"temporarily unavailable"}
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(server.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		It("should not retry other verbose errors", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusOK, `{"status":0,"error":"data, missing or empty"}`))
+			m.Verbose = true
+			m.Retry.RetryableErrors = []string{"temporarily unavailable"}
+			err := m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})
+			Expect(errors.Is(err, mixpanel.ErrUnexpectedTrackResponse)).To(BeTrue())
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+
+		It("should not retry by default", func() {
+			server.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, ""))
+			m.Retry = mixpanel.RetryConfig{}
+			Expect(m.Track("Signed Up", map[string]interface{}{"distinct_id": "1"})).To(Equal(mixpanel.ErrUnexpectedTrackResponse))
+			Expect(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Describe("Group profiles", func() {
+		groupRequest := func(expectedData, response string) {
+			verifyRequestResponse(server, "POST", `\A\/groups\/\z`, expectedData, response)
+		}
+
+		It("should set group properties", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$set":{"plan":"enterprise"}}`, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupSet("company_id", "acme", map[string]interface{}{"plan": "enterprise"})).To(Succeed())
+		})
+
+		It("should set group properties once", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$set_once":{"signed_up":"2021-03-04"}}`, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupSetOnce("company_id", "acme", map[string]interface{}{"signed_up": "2021-03-04"})).To(Succeed())
+		})
+
+		It("should union group list properties", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$union":{"products":["analytics"]}}`, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupUnion("company_id", "acme", map[string]interface{}{"products": []string{"analytics"}})).To(Succeed())
+		})
+
+		It("should unset group properties", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$unset":["trial_ends"]}`, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupUnset("company_id", "acme", []string{"trial_ends"})).To(Succeed())
+		})
+
+		It("should delete group profiles", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$delete":""}`, "1")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupDelete("company_id", "acme")).To(Succeed())
+		})
+
+		It("should return ErrUnexpectedGroupResponse when mixpanel responds with an error", func() {
+			groupRequest(`{"$token":"token","$group_key":"company_id","$group_id":"acme","$delete":""}`, "0")
+			m := mixpanel.NewMixpanelClient("token", baseURL)
+			Expect(m.GroupDelete("company_id", "acme")).To(Equal(mixpanel.ErrUnexpectedGroupResponse))
+		})
+	})
+
+	Describe("ContextExtractors", func() {
+		type tenantKey struct{}
+
+		var m *mixpanel.Mixpanel
+		var ctx context.Context
+
+		BeforeEach(func() {
+			m = mixpanel.NewMixpanelClient("token", baseURL)
+			m.ContextExtractors = []func(context.Context) map[string]interface{}{
+				func(ctx context.Context) map[string]interface{} {
+					return map[string]interface{}{"tenant": ctx.Value(tenantKey{}), "region": "eu"}
+				},
+				func(ctx context.Context) map[string]interface{} {
+					return map[string]interface{}{"region": "eu-west-1"}
+				},
+			}
+			ctx = context.WithValue(context.Background(), tenantKey{}, "acme")
+		})
+
+		It("should merge the extracted properties, later extractors first", func() {
+			verifyRequestResponse(server,
+				"POST",
+				`\A\/track\/\z`,
+				`{"event":"Report Viewed","properties":{"distinct_id":"1","tenant":"acme","region":"eu-west-1","token":"token"}}`,
+				"1",
+			)
+			Expect(m.TrackContext(ctx, "Report Viewed", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+		})
+
+		It("should let explicit properties take precedence", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.TrackContext(ctx, "Report Viewed", map[string]interface{}{"distinct_id": "1", "tenant": "other"})).To(Succeed())
+			Expect(data["properties"]).To(HaveKeyWithValue("tenant", "other"))
+		})
+
+		It("should enrich batches", func() {
+			batch := captureBatchData(server, "1")
+			Expect(m.TrackBatchContext(ctx, []mixpanel.Event{{Name: "Report Viewed"}})).To(Succeed())
+			Expect((*batch)[0]["properties"]).To(HaveKeyWithValue("tenant", "acme"))
+		})
+
+		It("should leave out the values missing from the context", func() {
+			data := captureRequestData(server, "1")
+			Expect(m.Track("Report Viewed", map[string]interface{}{"distinct_id": "1"})).To(Succeed())
+			Expect(data["properties"]).NotTo(HaveKey("tenant"))
+			Expect(data["properties"]).To(HaveKeyWithValue("region", "eu-west-1"))
+		})
+	})
 })
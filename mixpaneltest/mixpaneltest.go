@@ -0,0 +1,154 @@
+// Package mixpaneltest helps testing code that sends events and profile updates through a
+// mixpanel.Mixpanel, without sending anything to Mixpanel
+package mixpaneltest
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/nitrous-io/go-mixpanel"
+)
+
+// VolatileProperties are removed from captured payloads before they are compared, since they
+// differ on every call
+var VolatileProperties = []string{"$insert_id"}
+
+// Recorder is a mixpanel.Transport that keeps the payloads it is given instead of sending them
+type Recorder struct {
+	mu       sync.Mutex
+	payloads []interface{}
+	params   []url.Values
+}
+
+func (r *Recorder) Send(ctx context.Context, path string, params url.Values, data interface{}) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.payloads = append(r.payloads, data)
+	copied := url.Values{}
+	for key, values := range params {
+		copied[key] = append([]string(nil), values...)
+	}
+	r.params = append(r.params, copied)
+
+	return "1", nil
+}
+
+// Params returns the query parameters sent along with each payload recorded so far, e.g. "ip" or
+// "verbose", in the order the payloads were sent
+func (r *Recorder) Params() []url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]url.Values(nil), r.params...)
+}
+
+// Payloads returns the payloads recorded so far, in the order they were sent, as the JSON Mixpanel
+// would have received. A batch is a single payload holding an array of events
+func (r *Recorder) Payloads() ([]interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// round trip through JSON so the payloads compare like the JSON they are sent as
+	encoded, err := json.Marshal(r.payloads)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads []interface{}
+	if err := json.Unmarshal(encoded, &payloads); err != nil {
+		return nil, err
+	}
+
+	for _, payload := range payloads {
+		removeVolatile(payload)
+	}
+
+	return payloads, nil
+}
+
+// AssertPayload runs call with m sending to a Recorder, and fails t unless the payloads sent match
+// expectedJSON, ignoring VolatileProperties. When call sends a single payload expectedJSON is that
+// payload, otherwise it is an array of every payload sent. The query parameters sent along, e.g.
+// "ip" or "verbose", are checked by AssertParams instead.
+// m's Transport is restored once call returns
+// e.g. `mixpaneltest.AssertPayload(t, m, func() { m.Track("Signed Up", props) }, expectedJSON)`
+func AssertPayload(t testing.TB, m *mixpanel.Mixpanel, call func(), expectedJSON string) {
+	t.Helper()
+
+	recorder := &Recorder{}
+	transport := m.Transport
+	m.Transport = recorder
+	defer func() { m.Transport = transport }()
+
+	call()
+
+	payloads, err := recorder.Payloads()
+	if err != nil {
+		t.Errorf("mixpaneltest: could not encode the payloads: %v", err)
+		return
+	}
+
+	var expected interface{}
+	if err := json.Unmarshal([]byte(expectedJSON), &expected); err != nil {
+		t.Errorf("mixpaneltest: invalid expected JSON: %v", err)
+		return
+	}
+
+	var actual interface{} = payloads
+	if len(payloads) == 1 {
+		actual = payloads[0]
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		encoded, _ := json.Marshal(actual)
+		t.Errorf("mixpaneltest: payload mismatch\n  expected: %s\n    actual: %s", expectedJSON, encoded)
+	}
+}
+
+// AssertParams runs call with m sending to a Recorder, and fails t unless the query parameters sent
+// along with the payloads, which AssertPayload doesn't look at, match expected: one url.Values for
+// each payload, in the order they were sent.
+// m's Transport is restored once call returns
+// e.g. `mixpaneltest.AssertParams(t, m, func() { m.TrackWithGeo("1", "Check In", geo, nil) }, url.Values{"ip": {"0"}})`
+func AssertParams(t testing.TB, m *mixpanel.Mixpanel, call func(), expected ...url.Values) {
+	t.Helper()
+
+	recorder := &Recorder{}
+	transport := m.Transport
+	m.Transport = recorder
+	defer func() { m.Transport = transport }()
+
+	call()
+
+	actual := recorder.Params()
+	matches := len(actual) == len(expected)
+	for i := 0; matches && i < len(actual); i++ {
+		// a nil url.Values sends the same parameters as an empty one
+		matches = len(actual[i]) == 0 && len(expected[i]) == 0 || reflect.DeepEqual(actual[i], expected[i])
+	}
+
+	if !matches {
+		t.Errorf("mixpaneltest: params mismatch\n  expected: %v\n    actual: %v", expected, actual)
+	}
+}
+
+func removeVolatile(payload interface{}) {
+	switch payload := payload.(type) {
+	case map[string]interface{}:
+		for _, key := range VolatileProperties {
+			delete(payload, key)
+		}
+		for _, value := range payload {
+			removeVolatile(value)
+		}
+	case []interface{}:
+		for _, value := range payload {
+			removeVolatile(value)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package mixpaneltest_test
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/nitrous-io/go-mixpanel"
+	"github.com/nitrous-io/go-mixpanel/mixpaneltest"
+)
+
+type recordingT struct {
+	testing.TB
+	failures []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.failures = append(t.failures, fmt.Sprintf(format, args...))
+}
+
+func TestAssertPayload(t *testing.T) {
+	m := mixpanel.NewMixpanelClient("token")
+	m.EventNameAliases = map[string][]string{"Signed Up": {"User Signed Up"}}
+
+	mixpaneltest.AssertPayload(t, m, func() {
+		m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+	}, `[
+		{"event": "Signed Up", "properties": {"$distinct_id": "1", "token": "token"}},
+		{"event": "User Signed Up", "properties": {"$distinct_id": "1", "token": "token"}}
+	]`)
+
+	mixpaneltest.AssertPayload(t, m, func() {
+		m.ProfileSet("1", map[string]interface{}{"plan": "pro"})
+	}, `{"$token": "token", "$distinct_id": "1", "$set": {"plan": "pro"}}`)
+
+	if m.Transport != nil {
+		t.Errorf("expected the Transport to be restored, got %v", m.Transport)
+	}
+}
+
+func TestAssertPayloadMismatch(t *testing.T) {
+	m := mixpanel.NewMixpanelClient("token")
+	recorder := &recordingT{TB: t}
+
+	mixpaneltest.AssertPayload(recorder, m, func() {
+		m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+	}, `{"event": "Signed Up", "properties": {"$distinct_id": "2", "token": "token"}}`)
+
+	if len(recorder.failures) != 1 {
+		t.Errorf("expected a single failure, got %v", recorder.failures)
+	}
+}
+
+func TestAssertParams(t *testing.T) {
+	m := mixpanel.NewMixpanelClient("token")
+
+	mixpaneltest.AssertParams(t, m, func() {
+		m.TrackWithGeo("1", "Check In", mixpanel.Geo{CountryCode: "GB"}, nil)
+		m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+	}, url.Values{"ip": {"0"}}, nil)
+
+	m.Verbose = true
+	recorder := &recordingT{TB: t}
+	mixpaneltest.AssertParams(recorder, m, func() {
+		m.Track("Signed Up", map[string]interface{}{"$distinct_id": "1"})
+	}, nil)
+
+	if len(recorder.failures) != 1 {
+		t.Errorf("expected a single failure, got %v", recorder.failures)
+	}
+}
@@ -0,0 +1,52 @@
+package mixpanel
+
+import "sync"
+
+// orderedQueues runs the jobs submitted for each key one at a time, in the order they were
+// submitted, while jobs for different keys run concurrently
+type orderedQueues struct {
+	mu     sync.Mutex
+	queues map[string]*orderedQueue
+}
+
+type orderedQueue struct {
+	jobs []func()
+}
+
+// do runs job after every job previously submitted for key has finished, and returns its error
+func (q *orderedQueues) do(key string, job func() error) error {
+	done := make(chan error, 1)
+	run := func() { done <- job() }
+
+	q.mu.Lock()
+	if queue, ok := q.queues[key]; ok {
+		queue.jobs = append(queue.jobs, run)
+	} else {
+		if q.queues == nil {
+			q.queues = make(map[string]*orderedQueue)
+		}
+		queue = &orderedQueue{jobs: []func(){run}}
+		q.queues[key] = queue
+		go q.work(key, queue)
+	}
+	q.mu.Unlock()
+
+	return <-done
+}
+
+// work drains the queue, removing it once it is empty so idle keys don't hold on to memory
+func (q *orderedQueues) work(key string, queue *orderedQueue) {
+	for {
+		q.mu.Lock()
+		if len(queue.jobs) == 0 {
+			delete(q.queues, key)
+			q.mu.Unlock()
+			return
+		}
+		job := queue.jobs[0]
+		queue.jobs = queue.jobs[1:]
+		q.mu.Unlock()
+
+		job()
+	}
+}
@@ -0,0 +1,86 @@
+package mixpanel
+
+import (
+	"reflect"
+	"time"
+)
+
+const defaultProfileCacheTTL = 10 * time.Minute
+
+// WithProfileCache makes ProfileSet skip the request when every property already holds the value
+// this client last $set for the same distinct ID, remembering up to size distinct IDs for
+// ProfileCacheTTL after each was set. The cache is best-effort: it is kept per process, so updates made by other
+// processes or directly in Mixpanel aren't seen, and any other profile operation on a distinct ID
+// forgets what was cached for it. It returns m so it can be chained onto the constructor
+// e.g. `m := mixpanel.NewMixpanelClient("your_mixpanel_token").WithProfileCache(10000)`
+func (m *Mixpanel) WithProfileCache(size int) *Mixpanel {
+	// the properties expire on their own, see cachedProfileValue
+	m.profileCache = newLRUCache(size, 0)
+	return m
+}
+
+// cachedProfileValue is a property value last $set on a profile, and when it was set
+type cachedProfileValue struct {
+	value interface{}
+	set   time.Time
+}
+
+func (m *Mixpanel) profileCacheTTL() time.Duration {
+	if m.ProfileCacheTTL <= 0 {
+		return defaultProfileCacheTTL
+	}
+
+	return m.ProfileCacheTTL
+}
+
+// profileSetCached reports whether every property already holds the value cached for distinctID
+func (m *Mixpanel) profileSetCached(distinctID string, properties map[string]interface{}) bool {
+	if m.profileCache == nil {
+		return false
+	}
+
+	cached, ok := m.profileCache.Get(distinctID)
+	if !ok {
+		return false
+	}
+
+	values := cached.(map[string]cachedProfileValue)
+	ttl := m.profileCacheTTL()
+	for key, value := range properties {
+		cachedValue, ok := values[key]
+		if !ok || time.Since(cachedValue.set) > ttl || !reflect.DeepEqual(cachedValue.value, value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (m *Mixpanel) cacheProfileSet(distinctID string, properties map[string]interface{}) {
+	if m.profileCache == nil {
+		return
+	}
+
+	// the cached map is never modified, as profileSetCached may be reading it
+	values := make(map[string]cachedProfileValue)
+	ttl := m.profileCacheTTL()
+	if cached, ok := m.profileCache.Get(distinctID); ok {
+		for key, value := range cached.(map[string]cachedProfileValue) {
+			if time.Since(value.set) <= ttl {
+				values[key] = value
+			}
+		}
+	}
+	now := time.Now()
+	for key, value := range properties {
+		values[key] = cachedProfileValue{value: value, set: now}
+	}
+
+	m.profileCache.Set(distinctID, values)
+}
+
+func (m *Mixpanel) forgetProfile(distinctID string) {
+	if m.profileCache != nil {
+		m.profileCache.Remove(distinctID)
+	}
+}
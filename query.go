@@ -0,0 +1,351 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// The most query responses remembered under QueryCacheTTL
+const defaultQueryCacheSize = 1000
+
+// Mixpanel's encoding for date-time profile properties, always in UTC
+const profileTimeFormat = "2006-01-02T15:04:05"
+
+type engageQueryResponse struct {
+	Page      int       `json:"page"`
+	PageSize  int       `json:"page_size"`
+	SessionID string    `json:"session_id"`
+	Status    string    `json:"status"`
+	Total     int       `json:"total"`
+	Results   []Profile `json:"results"`
+}
+
+// Profile is a "People" profile as returned by the engage query API
+type Profile struct {
+	DistinctID string                 `json:"$distinct_id"`
+	Properties map[string]interface{} `json:"$properties"`
+}
+
+// GetString returns the property as a string, if it is one
+func (p Profile) GetString(key string) (string, bool) {
+	value, ok := p.Properties[key].(string)
+	return value, ok
+}
+
+// GetFloat returns the property as a number, also accepting numbers that Mixpanel stored as strings
+func (p Profile) GetFloat(key string) (float64, bool) {
+	switch value := p.Properties[key].(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+// GetTime returns the property as a time, accepting Mixpanel's "2006-01-02T15:04:05" date
+// encoding, RFC 3339 strings and Unix timestamps in seconds
+func (p Profile) GetTime(key string) (time.Time, bool) {
+	switch value := p.Properties[key].(type) {
+	case float64:
+		return time.Unix(int64(value), 0).UTC(), true
+	case string:
+		for _, layout := range []string{profileTimeFormat, time.RFC3339} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, true
+			}
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// ProfileCount returns the number of "People" profiles matching the where expression
+// without paging through the profiles themselves. An empty where counts every profile.
+// Requires APISecret to be set.
+// e.g. `count, err := m.ProfileCount(ctx, "properties[\"plan\"] == \"pro\"")`
+func (m *Mixpanel) ProfileCount(ctx context.Context, where string) (int, error) {
+	params := url.Values{}
+	params.Set("page", "0")
+	if len(where) > 0 {
+		params.Set("where", where)
+	}
+
+	var response engageQueryResponse
+	if err := m.query(ctx, "/2.0/engage/", params, &response); err != nil {
+		return 0, err
+	}
+
+	if response.Status != "ok" {
+		return 0, ErrUnexpectedQueryResponse
+	}
+
+	return response.Total, nil
+}
+
+// GetProfile returns the "People" profile referenced by the distinctID (which is the primary key),
+// or ErrProfileNotFound if there isn't one. Requires APISecret to be set
+// e.g. `profile, err := m.GetProfile(ctx, "1")`
+func (m *Mixpanel) GetProfile(ctx context.Context, distinctID string) (*Profile, error) {
+	params := url.Values{}
+	params.Set("distinct_id", distinctID)
+
+	var response engageQueryResponse
+	if err := m.query(ctx, "/2.0/engage/", params, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Status != "ok" {
+		return nil, ErrUnexpectedQueryResponse
+	}
+
+	if len(response.Results) == 0 {
+		return nil, ErrProfileNotFound
+	}
+
+	return &response.Results[0], nil
+}
+
+// ExportProfilesCSV writes the "People" profiles matching the where expression to w as CSV, paging
+// through all of them. The header row holds the columns, which are property names or "$distinct_id"
+// for the profile's distinct ID. Properties missing from a profile are left empty, and lists and
+// objects are written as JSON. Requires APISecret to be set
+// e.g. `err := m.ExportProfilesCSV(ctx, "properties[\"plan\"] == \"pro\"", []string{"$distinct_id", "$email", "plan"}, file)`
+func (m *Mixpanel) ExportProfilesCSV(ctx context.Context, where string, columns []string, w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(columns); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	if len(where) > 0 {
+		params.Set("where", where)
+	}
+
+	for page := 0; ; page++ {
+		params.Set("page", strconv.Itoa(page))
+
+		var response engageQueryResponse
+		if err := m.query(ctx, "/2.0/engage/", params, &response); err != nil {
+			return err
+		}
+
+		if response.Status != "ok" {
+			return ErrUnexpectedQueryResponse
+		}
+
+		for _, profile := range response.Results {
+			if err := writer.Write(profile.csvRecord(columns)); err != nil {
+				return err
+			}
+		}
+
+		// the following pages are read from the query session the first one started
+		params.Set("session_id", response.SessionID)
+		if len(response.Results) == 0 || len(response.Results) < response.PageSize {
+			break
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func (p Profile) csvRecord(columns []string) []string {
+	record := make([]string, len(columns))
+
+	for i, column := range columns {
+		if column == "$distinct_id" {
+			record[i] = p.DistinctID
+			continue
+		}
+
+		switch value := p.Properties[column].(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case float64:
+			record[i] = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			record[i] = strconv.FormatBool(value)
+		default:
+			encoded, _ := json.Marshal(value)
+			record[i] = string(encoded)
+		}
+	}
+
+	return record
+}
+
+// InsightsResult is the data behind a saved Insights report
+type InsightsResult struct {
+	ComputedAt string                    `json:"computed_at"`
+	DateRange  InsightsDateRange         `json:"date_range"`
+	Headers    []string                  `json:"headers"`
+	Series     map[string]InsightsSeries `json:"series"`
+}
+
+type InsightsDateRange struct {
+	From string `json:"from_date"`
+	To   string `json:"to_date"`
+}
+
+// InsightsSeries is one metric of an Insights report. Values holds the metric by date; reports
+// with a breakdown instead nest a series per breakdown value (including "$overall") in Breakdowns
+type InsightsSeries struct {
+	Values     map[string]float64
+	Breakdowns map[string]InsightsSeries
+}
+
+func (s *InsightsSeries) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+
+	for key, field := range fields {
+		var value float64
+		if err := json.Unmarshal(field, &value); err == nil {
+			if s.Values == nil {
+				s.Values = make(map[string]float64)
+			}
+			s.Values[key] = value
+			continue
+		}
+
+		var breakdown InsightsSeries
+		if err := json.Unmarshal(field, &breakdown); err != nil {
+			return err
+		}
+		if s.Breakdowns == nil {
+			s.Breakdowns = make(map[string]InsightsSeries)
+		}
+		s.Breakdowns[key] = breakdown
+	}
+
+	return nil
+}
+
+// QueryInsights returns the data behind the saved Insights report with the given bookmark ID.
+// Requires APISecret, and ProjectID when authenticating with a service account
+// e.g. `result, err := m.QueryInsights(ctx, 12345)`
+func (m *Mixpanel) QueryInsights(ctx context.Context, bookmarkID int) (InsightsResult, error) {
+	params := url.Values{}
+	params.Set("bookmark_id", strconv.Itoa(bookmarkID))
+	if m.ProjectID != 0 {
+		params.Set("project_id", strconv.Itoa(m.ProjectID))
+	}
+
+	var result InsightsResult
+	err := m.query(ctx, "/2.0/insights", params, &result)
+
+	return result, err
+}
+
+type projectResponse struct {
+	Status  string `json:"status"`
+	Results struct {
+		Timezone string `json:"timezone"`
+	} `json:"results"`
+}
+
+// ProjectTimezone returns the timezone configured for the project, which Mixpanel's reports use to
+// bucket dates. It is fetched from the project settings API once and cached afterwards.
+// Requires APISecret and ProjectID to be set
+// e.g. `location, err := m.ProjectTimezone(ctx)`
+func (m *Mixpanel) ProjectTimezone(ctx context.Context) (*time.Location, error) {
+	m.timezoneMu.Lock()
+	defer m.timezoneMu.Unlock()
+
+	if m.timezone != nil {
+		return m.timezone, nil
+	}
+
+	if m.ProjectID == 0 {
+		return nil, ErrMissingProjectID
+	}
+
+	var response projectResponse
+	if err := m.query(ctx, fmt.Sprintf("/app/projects/%d", m.ProjectID), url.Values{}, &response); err != nil {
+		return nil, err
+	}
+
+	if response.Status != "ok" || len(response.Results.Timezone) == 0 {
+		return nil, ErrUnexpectedQueryResponse
+	}
+
+	location, err := time.LoadLocation(response.Results.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	m.timezone = location
+	return location, nil
+}
+
+func (m *Mixpanel) query(ctx context.Context, path string, params url.Values, v interface{}) error {
+	key := path + "?" + params.Encode()
+	if m.QueryCacheTTL > 0 {
+		if body, ok := m.queryResponses().Get(key); ok {
+			return json.Unmarshal(body.([]byte), v)
+		}
+	}
+
+	body, err := m.fetchQuery(ctx, path, params)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return err
+	}
+
+	if m.QueryCacheTTL > 0 {
+		m.queryResponses().Set(key, body)
+	}
+
+	return nil
+}
+
+// fetchQuery returns the body of the query API's response, bypassing QueryCacheTTL
+func (m *Mixpanel) fetchQuery(ctx context.Context, path string, params url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", m.QueryURL+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(m.APISecret, "")
+	if m.RequestSigner != nil {
+		m.RequestSigner(req)
+	}
+
+	res, err := m.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	m.observeDeprecation(path, res.Header)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, ErrUnexpectedQueryResponse
+	}
+
+	return ioutil.ReadAll(res.Body)
+}
+
+func (m *Mixpanel) queryResponses() *lruCache {
+	m.queryCacheOnce.Do(func() {
+		m.queryCache = newLRUCache(defaultQueryCacheSize, m.QueryCacheTTL)
+	})
+
+	return m.queryCache
+}
@@ -0,0 +1,137 @@
+package mixpanel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Properties added by Mixpanel on ingestion that the import API doesn't accept back
+var exportOnlyProperties = []string{"mp_processing_time_ms"}
+
+// BatchResult counts the events of a bulk operation
+type BatchResult struct {
+	// Sent is the number of events Mixpanel accepted
+	Sent int
+	// Failed is the number of events that could not be read or that Mixpanel rejected
+	Failed int
+	// Skipped is the number of events not sent because the IdempotencyStore holds their $insert_id
+	Skipped int
+}
+
+type exportedEvent struct {
+	Event      string                 `json:"event"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// Replay reads events in the newline delimited JSON format of Mixpanel's export API from src and
+// imports them into dst's project through the import API, which requires dst.APISecret.
+// Each event keeps its original "time", and events exported without an "$insert_id" get one derived
+// from their content, so replaying the same export twice doesn't duplicate events.
+// Lines that can't be parsed or have no "time" are counted as failed and skipped; batches Mixpanel
+// rejects are counted as failed and passed to dst.OnDeadLetter.
+// Batches are sent as soon as they fill up, so when reading src fails or ctx is done the events
+// before are already imported, as the returned result counts
+// e.g. `result, err := mixpanel.Replay(ctx, exportFile, mixpanel.NewMixpanelClient("new_project_token"))`
+func Replay(ctx context.Context, src io.Reader, dst *Mixpanel) (BatchResult, error) {
+	var result BatchResult
+	var events []Event
+	reader := bufio.NewReader(src)
+
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if readErr != nil && readErr != io.EOF {
+			return result, readErr
+		}
+
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if event, ok := importableEvent(line); ok {
+				events = append(events, event)
+			} else {
+				result.Failed++
+			}
+		}
+
+		// events are sent as soon as a batch fills up, so that an export of any size is
+		// replayed without holding it all in memory
+		if len(events) == maxBatchSize || (readErr == io.EOF && len(events) > 0) {
+			if err := dst.replayBatch(ctx, events, &result); err != nil {
+				return result, err
+			}
+			events = nil
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d of %d Mixpanel events could not be replayed", result.Failed, result.Sent+result.Failed)
+	}
+
+	return result, nil
+}
+
+// replayBatch imports a batch of exported events, adding up the outcome in result. The
+// DuplicateInsertIDs policy is applied within the batch, since the events before it are already
+// sent; across batches the import API deduplicates them by $insert_id
+func (m *Mixpanel) replayBatch(ctx context.Context, events []Event, result *BatchResult) error {
+	events, err := m.checkInsertIDs(events)
+	if err != nil {
+		return err
+	}
+	unsent, err := m.unsentEvents(ctx, events)
+	if err != nil {
+		return err
+	}
+	result.Skipped += len(events) - len(unsent)
+
+	for _, chunk := range m.chunkEvents(unsent) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := m.sendBatch(ctx, importPath, chunk, nil); err != nil {
+			m.deadLetter(chunk, err)
+			result.Failed += len(chunk)
+		} else {
+			m.markSent(ctx, chunk)
+			result.Sent += len(chunk)
+		}
+	}
+
+	return nil
+}
+
+// importableEvent converts a line of export output into an event for the import API
+func importableEvent(line []byte) (Event, bool) {
+	var exported exportedEvent
+	// numbers are kept as they were exported, since large integers don't survive a float64
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	if err := decoder.Decode(&exported); err != nil || len(exported.Event) == 0 {
+		return Event{}, false
+	}
+
+	if _, ok := exported.Properties["time"]; !ok {
+		return Event{}, false
+	}
+
+	for _, key := range exportOnlyProperties {
+		delete(exported.Properties, key)
+	}
+
+	if _, ok := exported.Properties["$insert_id"]; !ok {
+		sum := sha256.Sum256(line)
+		// Mixpanel caps insert IDs at 36 characters
+		exported.Properties["$insert_id"] = hex.EncodeToString(sum[:16])
+	}
+
+	return Event{Name: exported.Event, Properties: exported.Properties}, true
+}
@@ -0,0 +1,185 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Second
+)
+
+// RetryConfig configures the retries of requests that get no response, or that Mixpanel answers
+// with HTTP status 429, 500, 502, 503 or 504. The delay doubles with each attempt, with jitter,
+// unless Mixpanel asks for a specific one with a Retry-After header. Other statuses are never
+// retried. Profile updates that add to a property ($add and $append), and events without an
+// $insert_id for Mixpanel to deduplicate them by, are only retried after a 429, since otherwise
+// Mixpanel may have applied them already. Once the attempts run out the last response or error
+// is handled as if there had been no retries, e.g. returning ErrUnexpectedTrackResponse
+type RetryConfig struct {
+	// MaxAttempts is the number of times a request is sent, including the first (defaults to 1)
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry (defaults to 100ms)
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between attempts, including one asked for by Retry-After (defaults to 5 seconds)
+	MaxDelay time.Duration
+	// RetryableErrors lists substrings of the errors in verbose responses (see Verbose) that are
+	// transient, so that the payloads Mixpanel rejects with them are retried like after a 429
+	// e.g. `mixpanel.RetryConfig{MaxAttempts: 3, RetryableErrors: []string{"temporarily unavailable"}}`
+	RetryableErrors []string
+}
+
+type minAttemptsKey struct{}
+
+// withMinAttempts returns a copy of ctx under which requests are sent up to attempts times, even
+// when Retry allows fewer
+func withMinAttempts(ctx context.Context, attempts int) context.Context {
+	return context.WithValue(ctx, minAttemptsKey{}, attempts)
+}
+
+// retryConfig returns Retry, raised to the attempts asked for by withMinAttempts
+func (m *Mixpanel) retryConfig(ctx context.Context) RetryConfig {
+	config := m.Retry
+	if attempts, ok := ctx.Value(minAttemptsKey{}).(int); ok && config.maxAttempts() < attempts {
+		config.MaxAttempts = attempts
+	}
+
+	return config
+}
+
+func (c RetryConfig) maxAttempts() int {
+	if c.MaxAttempts < 1 {
+		return 1
+	}
+
+	return c.MaxAttempts
+}
+
+// delay returns how long to wait after the attempt-th attempt failed with a response carrying header
+func (c RetryConfig) delay(attempt int, header http.Header) time.Duration {
+	maxDelay := c.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+
+	if after, ok := retryAfter(header.Get("Retry-After")); ok {
+		if after > maxDelay {
+			return maxDelay
+		}
+		return after
+	}
+
+	delay := c.BaseDelay
+	if delay <= 0 {
+		delay = defaultRetryBaseDelay
+	}
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// somewhere between half and all of the delay, so that clients that failed together don't
+	// all retry together
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter parses a Retry-After header, which holds either seconds or an HTTP date
+func retryAfter(value string) (time.Duration, bool) {
+	if len(value) == 0 {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		if after := time.Until(at); after > 0 {
+			return after, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// retryableError reports whether the verbose response carries one of the RetryableErrors
+func (c RetryConfig) retryableError(response string) bool {
+	if len(c.RetryableErrors) == 0 {
+		return false
+	}
+
+	var verbose verboseResponse
+	if err := json.Unmarshal([]byte(response), &verbose); err != nil || verbose.Status == 1 {
+		return false
+	}
+
+	for _, substring := range c.RetryableErrors {
+		if strings.Contains(verbose.Error, substring) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryable reports whether a request carrying data may be sent again after a response with status,
+// which is zero when there was no response
+func retryable(status int, data interface{}) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		// rate limited requests weren't processed
+		return true
+	case 0, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return !additive(data) && !unidentified(data)
+	}
+
+	return false
+}
+
+// unidentified reports whether data holds an event without an $insert_id, which would be counted
+// twice if sent twice
+func unidentified(data interface{}) bool {
+	var events []map[string]interface{}
+	switch data := data.(type) {
+	case map[string]interface{}:
+		events = []map[string]interface{}{data}
+	case []map[string]interface{}:
+		events = data
+	default:
+		return false
+	}
+
+	for _, event := range events {
+		if _, ok := event["event"]; !ok {
+			continue
+		}
+		properties, _ := event["properties"].(map[string]interface{})
+		if _, ok := properties["$insert_id"]; !ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// additive reports whether data is a profile update that would be applied twice if sent twice
+func additive(data interface{}) bool {
+	update, ok := data.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	_, add := update["$add"]
+	_, appended := update["$append"]
+
+	return add || appended
+}
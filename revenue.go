@@ -0,0 +1,40 @@
+package mixpanel
+
+import (
+	"strings"
+	"time"
+)
+
+// TrackChargeWithCurrency appends a charge of amount in currency (an ISO 4217 code, e.g. "EUR") to
+// the "$transactions" of the profile referenced by distinctID, which Mixpanel's revenue reports sum
+// up. The charge's "$amount" is converted to BaseCurrency with CurrencyConverter so that charges in
+// different currencies add up, while "original_amount" and "currency" keep what was charged.
+// Charges already in BaseCurrency don't need a CurrencyConverter; other charges return
+// ErrMissingCurrencyConverter without one
+// e.g. `err := m.TrackChargeWithCurrency("1", 9.99, "EUR", map[string]interface{}{"plan": "pro"})`
+func (m *Mixpanel) TrackChargeWithCurrency(distinctID string, amount float64, currency string, properties map[string]interface{}) error {
+	currency = strings.ToUpper(currency)
+
+	normalized := amount
+	if currency != strings.ToUpper(m.BaseCurrency) {
+		if m.CurrencyConverter == nil || len(m.BaseCurrency) == 0 {
+			return ErrMissingCurrencyConverter
+		}
+
+		var err error
+		if normalized, err = m.CurrencyConverter(amount, currency, strings.ToUpper(m.BaseCurrency)); err != nil {
+			return err
+		}
+	}
+
+	transaction := make(map[string]interface{}, len(properties)+4)
+	for key, value := range properties {
+		transaction[key] = value
+	}
+	transaction["$amount"] = normalized
+	transaction["$time"] = time.Now().UTC().Format(profileTimeFormat)
+	transaction["original_amount"] = amount
+	transaction["currency"] = currency
+
+	return m.ProfileAppend(distinctID, map[string]interface{}{"$transactions": transaction})
+}
@@ -0,0 +1,70 @@
+package mixpanel
+
+import "strings"
+
+// UnknownPropertyMode decides what Track does with properties an EventSchema doesn't list
+type UnknownPropertyMode int
+
+const (
+	// DropUnknown removes the unlisted properties before sending the event
+	DropUnknown UnknownPropertyMode = iota
+	// RejectUnknown fails the Track with ErrUnknownProperty without sending the event
+	RejectUnknown
+)
+
+// EventSchema lists the properties an event may carry. Reserved properties (those starting with
+// "$" or "mp_", "token", "time", "distinct_id" and "ip") are always allowed, as are the properties
+// Track adds itself
+type EventSchema struct {
+	Properties []string
+	Unknown    UnknownPropertyMode
+}
+
+func (s EventSchema) allows(property string) bool {
+	// schema_version is added by Track, but the caller's own value overrides it
+	if isReservedProperty(property) || property == schemaVersionProperty {
+		return true
+	}
+
+	for _, allowed := range s.Properties {
+		if property == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applySchema drops or rejects the properties that the event's schema in Schemas doesn't list
+func (m *Mixpanel) applySchema(event string, properties map[string]interface{}) error {
+	schema, ok := m.Schemas[event]
+	if !ok {
+		return nil
+	}
+
+	var unknown []string
+	for property := range properties {
+		if !schema.allows(property) {
+			unknown = append(unknown, property)
+		}
+	}
+
+	if len(unknown) > 0 && schema.Unknown == RejectUnknown {
+		return ErrUnknownProperty
+	}
+
+	for _, property := range unknown {
+		delete(properties, property)
+	}
+
+	return nil
+}
+
+func isReservedProperty(property string) bool {
+	switch property {
+	case "token", "time", "distinct_id", "ip":
+		return true
+	}
+
+	return strings.HasPrefix(property, "$") || strings.HasPrefix(property, "mp_")
+}
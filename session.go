@@ -0,0 +1,64 @@
+package mixpanel
+
+import "sync"
+
+// Session tracks the events of a single visitor who may not be identified yet. Every event carries
+// the session's generated "$device_id", and once Identify has been called also the "$user_id".
+// There is no separate identity merge step: with Mixpanel's Simplified ID Merge the first event
+// that carries both IDs links the anonymous events to the user. Projects still on the original
+// ID Merge should alias the device's distinct ID ("$device:<device id>") with
+// ProfileCreateAliasDistinctIdToAlias when the user signs up.
+// A Session is safe for concurrent use
+type Session struct {
+	m        *Mixpanel
+	deviceID string
+
+	mu     sync.Mutex
+	userID string
+}
+
+// NewSession starts a Session with a device ID from DeviceIDGenerator
+// e.g. `s := m.NewSession()`
+func (m *Mixpanel) NewSession() *Session {
+	generate := m.DeviceIDGenerator
+	if generate == nil {
+		generate = randomID
+	}
+
+	return &Session{m: m, deviceID: generate()}
+}
+
+// DeviceID returns the session's "$device_id"
+func (s *Session) DeviceID() string {
+	return s.deviceID
+}
+
+// Identify attributes the session's subsequent events to userID
+// e.g. `s.Identify("1")`
+func (s *Session) Identify(userID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userID = userID
+}
+
+// Track tracks the event as performed by the session's visitor, setting the "$device_id",
+// "$user_id" and "distinct_id" properties
+// e.g. `err := s.Track("Page Viewed", map[string]interface{}{"page": "/pricing"})`
+func (s *Session) Track(event string, properties map[string]interface{}) error {
+	s.mu.Lock()
+	userID := s.userID
+	s.mu.Unlock()
+
+	properties = copyProperties(properties)
+	properties["$device_id"] = s.deviceID
+
+	if len(userID) > 0 {
+		properties["$user_id"] = userID
+		properties["distinct_id"] = userID
+	} else {
+		properties["distinct_id"] = "$device:" + s.deviceID
+	}
+
+	return s.m.Track(event, properties)
+}
@@ -0,0 +1,83 @@
+package mixpanel
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Transport delivers the payloads of the ingestion endpoints ("/track/", "/engage/", "/groups/" and "/import/")
+// and returns Mixpanel's response body, which is "1" on success.
+// When a Mixpanel has no Transport the payloads are sent over HTTP to BaseURL
+type Transport interface {
+	Send(ctx context.Context, path string, params url.Values, data interface{}) (string, error)
+}
+
+type httpTransport struct {
+	m *Mixpanel
+}
+
+// HTTPTransport returns the Transport that sends m's payloads over HTTP to m.BaseURL
+func HTTPTransport(m *Mixpanel) Transport {
+	return httpTransport{m: m}
+}
+
+func (t httpTransport) Send(ctx context.Context, path string, params url.Values, data interface{}) (string, error) {
+	return t.m.post(ctx, path, params, data)
+}
+
+// FileSink is a Transport that writes payloads to a writer as newline delimited JSON instead of
+// sending them, e.g. for offline development. Events are written one per line in the format Replay
+// reads, stamped with the time they were written unless they already have one, so a file captured
+// offline can be imported later. Profile updates are written one per line as well, but Replay only
+// imports events and counts those lines as failed.
+// A FileSink is safe for concurrent use
+type FileSink struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+// NewFileSink returns a FileSink writing to w
+// e.g. `m.Transport = mixpanel.NewFileSink(file)`
+func NewFileSink(w io.Writer) *FileSink {
+	return &FileSink{encoder: json.NewEncoder(w)}
+}
+
+func (f *FileSink) Send(ctx context.Context, path string, params url.Values, data interface{}) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	lines := []interface{}{data}
+	if batch, ok := data.([]map[string]interface{}); ok {
+		lines = make([]interface{}, len(batch))
+		for i, event := range batch {
+			lines[i] = event
+		}
+	}
+
+	for _, line := range lines {
+		if event, ok := line.(map[string]interface{}); ok {
+			stampTime(event)
+		}
+
+		if err := f.encoder.Encode(line); err != nil {
+			return "", err
+		}
+	}
+
+	return "1", nil
+}
+
+func stampTime(event map[string]interface{}) {
+	properties, ok := event["properties"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if _, ok := properties["time"]; !ok {
+		properties["time"] = time.Now().Unix()
+	}
+}
@@ -0,0 +1,81 @@
+package mixpanel
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// unionEnvelopeBytes is left out of MaxPayloadBytes for the rest of an engage request
+const unionEnvelopeBytes = 1024
+
+// chunkUnion splits the lists of a $union into as many property maps as it takes for each to be
+// sent within MaxPayloadBytes. The values that aren't lists go with the first map
+func (m *Mixpanel) chunkUnion(properties map[string]interface{}) []map[string]interface{} {
+	maxBytes := m.maxPayloadBytes() - unionEnvelopeBytes
+	if encoded, err := json.Marshal(properties); err != nil || base64.StdEncoding.EncodedLen(len(encoded)) <= maxBytes {
+		// a payload that fails to encode is reported when it is sent
+		return []map[string]interface{}{properties}
+	}
+
+	first := make(map[string]interface{})
+	lists := make(map[string]reflect.Value)
+	var keys []string
+
+	for key, value := range properties {
+		list := reflect.ValueOf(value)
+		if list.Kind() != reflect.Slice && list.Kind() != reflect.Array {
+			first[key] = value
+			continue
+		}
+
+		lists[key] = list
+		keys = append(keys, key)
+	}
+	// split the lists in a stable order
+	sort.Strings(keys)
+
+	chunks := []map[string]interface{}{first}
+	chunk := first
+	encoded, _ := json.Marshal(first)
+	chunkBytes := len(encoded)
+
+	for _, key := range keys {
+		list := lists[key]
+		var values []interface{}
+
+		for i := 0; i < list.Len(); i++ {
+			value := list.Index(i).Interface()
+			encoded, _ := json.Marshal(value)
+			// the value and its comma
+			valueBytes := len(encoded) + 1
+			// the key and brackets of the list, when it isn't started yet in this chunk
+			listBytes := len(key) + 6
+			if values != nil {
+				listBytes = 0
+			}
+
+			if chunkBytes > 2 && base64.StdEncoding.EncodedLen(chunkBytes+listBytes+valueBytes) > maxBytes {
+				if values != nil {
+					chunk[key] = values
+				}
+
+				chunk = make(map[string]interface{})
+				chunks = append(chunks, chunk)
+				chunkBytes = 2
+				values = nil
+				listBytes = len(key) + 6
+			}
+
+			values = append(values, value)
+			chunkBytes += listBytes + valueBytes
+		}
+
+		if values != nil {
+			chunk[key] = values
+		}
+	}
+
+	return chunks
+}
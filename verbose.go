@@ -0,0 +1,58 @@
+package mixpanel
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// VerboseError is returned under Verbose when Mixpanel rejects a payload, carrying the reason it
+// gave. It unwraps to the error returned without Verbose, e.g. ErrUnexpectedTrackResponse
+type VerboseError struct {
+	Err     error
+	Message string
+}
+
+func (e *VerboseError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Message)
+}
+
+func (e *VerboseError) Unwrap() error {
+	return e.Err
+}
+
+// withVerbose returns params asking for a verbose response when Verbose is set
+func (m *Mixpanel) withVerbose(params url.Values) url.Values {
+	if !m.Verbose || params.Get("verbose") == "1" {
+		return params
+	}
+
+	verbose := url.Values{"verbose": {"1"}}
+	for key, values := range params {
+		verbose[key] = values
+	}
+
+	return verbose
+}
+
+// checkResponse turns the response of an ingestion endpoint into unexpected, or a VerboseError
+// wrapping it, unless it reports success
+func (m *Mixpanel) checkResponse(response string, unexpected error) error {
+	if response == "1" {
+		return nil
+	}
+
+	if !m.Verbose {
+		return unexpected
+	}
+
+	var verbose verboseResponse
+	if err := json.Unmarshal([]byte(response), &verbose); err != nil {
+		return unexpected
+	}
+	if verbose.Status == 1 {
+		return nil
+	}
+
+	return &VerboseError{Err: unexpected, Message: verbose.Error}
+}